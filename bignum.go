@@ -0,0 +1,365 @@
+package spack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// Arbitrary-precision numbers (*big.Int, *big.Float, *big.Rat, or the
+// values themselves) have their own kinds. Each starts with a byte that
+// is 0 for nil; the rest is sign and magnitude:
+//
+//   Int    1 (>= 0) or 2 (< 0), magnitude
+//   Rat    1 or 2, numerator magnitude, denominator magnitude
+//   Float  1 + negative + 2 * form (0 zero, 1 finite, 2 inf), precision,
+//          rounding mode byte; finite values add the exponent and the
+//          mantissa as an integer of precision bits
+//
+// Magnitudes are a length and big-endian bytes. Map mode and JSON use
+// exact strings: decimal for Int, "a/b" for Rat, and the shortest
+// decimal that round-trips at the Float's precision.
+const BIG_INT reflect.Kind = 251
+const BIG_FLOAT reflect.Kind = 252
+const BIG_RAT reflect.Kind = 253
+
+var bigTypes = map[reflect.Kind]reflect.Type{
+	BIG_INT: reflect.TypeOf(big.Int{}),
+	BIG_FLOAT: reflect.TypeOf(big.Float{}),
+	BIG_RAT: reflect.TypeOf(big.Rat{}),
+}
+
+func isBigKind(kind reflect.Kind) bool {
+	return kind >= BIG_INT && kind <= BIG_RAT
+}
+
+// bigKindOf matches the big types and pointers to them.
+func bigKindOf(typ reflect.Type) (reflect.Kind, bool) {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	for kind, bigType := range bigTypes {
+		if typ == bigType {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// bigValue turns a Go or map-mode value into a pointer of the kind's
+// type, or nil. Strings are parsed; Ints also take integers, Floats and
+// Rats any number.
+func bigValue(field interface{}, kind reflect.Kind) (interface{}, error) {
+	var val = reflect.ValueOf(field)
+	for val.IsValid() && val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if !val.IsValid() || (val.Kind() == reflect.Ptr && val.IsNil()) {
+		return nil, nil
+	}
+
+	var typ = bigTypes[kind]
+	switch {
+	case val.Type() == reflect.PtrTo(typ):
+		return val.Interface(), nil
+	case val.Type() == typ:
+		var ptr = reflect.New(typ)
+		ptr.Elem().Set(val)
+		return ptr.Interface(), nil
+	case val.Kind() == reflect.String:
+		return parseBig(val.String(), kind)
+	}
+
+	var f, isNum = numberOf(val)
+	if !isNum {
+		return nil, fmt.Errorf("%v is not a %s", val.Type(), kindName(uint8(kind)))
+	}
+
+	switch kind {
+	case BIG_INT:
+		switch {
+		case val.CanInt():
+			return new(big.Int).SetInt64(val.Int()), nil
+		case val.CanUint():
+			return new(big.Int).SetUint64(val.Uint()), nil
+		}
+		return nil, fmt.Errorf("%v is not an integer", val.Type())
+	case BIG_FLOAT:
+		return big.NewFloat(f), nil
+	default:
+		if val.CanInt() {
+			return new(big.Rat).SetInt64(val.Int()), nil
+		}
+		if val.CanUint() {
+			return new(big.Rat).SetInt(new(big.Int).SetUint64(val.Uint())), nil
+		}
+		var r, ok = new(big.Rat).SetString(fmt.Sprint(f))
+		if !ok {
+			return nil, fmt.Errorf("%v is not a rational number", f)
+		}
+		return r, nil
+	}
+}
+
+func parseBig(text string, kind reflect.Kind) (interface{}, error) {
+	switch kind {
+	case BIG_INT:
+		if n, ok := new(big.Int).SetString(text, 0); ok {
+			return n, nil
+		}
+	case BIG_FLOAT:
+		// Enough bits for every digit, so distinct decimals stay distinct
+		var prec = uint(64)
+		if uint(len(text)) * 4 > prec {
+			prec = uint(len(text)) * 4
+		}
+		if f, _, err := big.ParseFloat(text, 0, prec, big.ToNearestEven); err == nil {
+			return f, nil
+		}
+	case BIG_RAT:
+		if r, ok := new(big.Rat).SetString(text); ok {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a %s", text, kindName(uint8(kind)))
+}
+
+// bigText is the map-mode string for a pointer from bigValue.
+func bigText(ptr interface{}) string {
+	switch x := ptr.(type) {
+	case *big.Int:
+		return x.String()
+	case *big.Float:
+		return x.Text('g', -1)
+	case *big.Rat:
+		return x.RatString()
+	}
+	return fmt.Sprint(ptr)
+}
+
+func (e *encoder) encodeBig(val reflect.Value, kind reflect.Kind) error {
+	var field interface{}
+	if val.IsValid() {
+		field = val.Interface()
+	}
+	var ptr, err = bigValue(field, kind)
+	if err != nil {
+		return err
+	}
+
+	switch x := ptr.(type) {
+	case nil:
+		e.buf = append(e.buf, 0)
+
+	case *big.Int:
+		e.buf = append(e.buf, bigSign(x.Sign()))
+		e.buf = appendMagnitude(e.buf, x)
+
+	case *big.Rat:
+		e.buf = append(e.buf, bigSign(x.Sign()))
+		e.buf = appendMagnitude(e.buf, x.Num())
+		e.buf = appendMagnitude(e.buf, x.Denom())
+
+	case *big.Float:
+		var form byte
+		switch {
+		case x.IsInf():
+			form = 2
+		case x.Sign() != 0:
+			form = 1
+		}
+		var neg byte
+		if x.Signbit() {
+			neg = 1
+		}
+		e.buf = append(e.buf, 1 + neg + 2 * form)
+		e.buf = binary.AppendUvarint(e.buf, uint64(x.Prec()))
+		e.buf = append(e.buf, byte(x.Mode()))
+
+		if form == 1 {
+			var exp = x.MantExp(nil)
+			var mant = new(big.Float).Abs(x)
+			mant.SetMantExp(mant, int(x.Prec()) - exp)
+			var mantInt, _ = mant.Int(nil)
+
+			e.buf = binary.AppendVarint(e.buf, int64(exp))
+			e.buf = appendMagnitude(e.buf, mantInt)
+		}
+	}
+	return nil
+}
+
+func bigSign(sign int) byte {
+	if sign < 0 {
+		return 2
+	}
+	return 1
+}
+
+func appendMagnitude(buf []byte, n *big.Int) []byte {
+	var size = (n.BitLen() + 7) / 8
+	buf = appendLength(buf, size)
+	var start = len(buf)
+	buf = append(buf, make([]byte, size)...)
+	n.FillBytes(buf[start:])
+	return buf
+}
+
+func (d *decoder) readMagnitude() (*big.Int, error) {
+	var length, err = binary.ReadUvarint(d.reader)
+	if err != nil {
+		return nil, readError("magnitude length", err)
+	}
+	if err := checkLen("", length, 0); err != nil {
+		return nil, err
+	}
+	if err := d.allocBytes(length, 1); err != nil {
+		return nil, err
+	}
+	mag, err := d.reader.next(length)
+	if err != nil {
+		return nil, readError("magnitude", err)
+	}
+	return new(big.Int).SetBytes(mag), nil
+}
+
+// decodeBig reads into a pointer to a big type, a pointer to a pointer
+// to one, or (in map mode) a pointer to an empty interface, which gets
+// the value's string.
+func (d *decoder) decodeBig(field interface{}, kind reflect.Kind) error {
+	var target = reflect.ValueOf(field).Elem()
+	var anyTarget = target.Kind() == reflect.Interface && target.NumMethod() == 0
+	if k, ok := bigKindOf(target.Type()); (!ok || k != kind) && !anyTarget {
+		return &TypeError{ fmt.Sprintf("Can't decode %s into %T", kindName(uint8(kind)), field) }
+	}
+
+	var c, err = d.reader.ReadByte()
+	if err != nil {
+		return readError(kindName(uint8(kind)) + " header", err)
+	}
+
+	var ptr interface{}
+	if c != 0 {
+		ptr, err = d.readBig(c, kind)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case anyTarget:
+		if ptr == nil {
+			target.Set(reflect.Zero(target.Type()))
+			break
+		}
+		// A float's exact decimal grows with its exponent rather than
+		// the input, and takes quadratic time to make, so it's limited
+		// like a string of a digit per bit
+		if f, ok := ptr.(*big.Float); ok && !f.IsInf() {
+			var exp = int64(f.MantExp(nil))
+			if exp < 0 {
+				exp = -exp
+			}
+			var digits = uint64(exp) + uint64(f.Prec())
+			if err := checkLen("MaxStringLen", digits, d.limits.MaxStringLen); err != nil {
+				return err
+			}
+			if err := d.allocBytes(digits, 1); err != nil {
+				return err
+			}
+		}
+		target.Set(reflect.ValueOf(bigText(ptr)))
+
+	case target.Kind() == reflect.Ptr:
+		if ptr == nil {
+			target.Set(reflect.Zero(target.Type()))
+		} else {
+			target.Set(reflect.ValueOf(ptr))
+		}
+
+	case ptr == nil:
+		target.Set(reflect.Zero(target.Type()))
+
+	default:
+		target.Set(reflect.ValueOf(ptr).Elem())
+	}
+	return nil
+}
+
+func (d *decoder) readBig(c byte, kind reflect.Kind) (interface{}, error) {
+	switch kind {
+	case BIG_INT:
+		var n, err = d.readMagnitude()
+		if err != nil {
+			return nil, err
+		}
+		if c == 2 {
+			n.Neg(n)
+		}
+		return n, nil
+
+	case BIG_RAT:
+		var num, err = d.readMagnitude()
+		if err != nil {
+			return nil, err
+		}
+		denom, err := d.readMagnitude()
+		if err != nil {
+			return nil, err
+		}
+		if denom.Sign() == 0 {
+			return nil, &TypeError{ "Rational with zero denominator" }
+		}
+		if c == 2 {
+			num.Neg(num)
+		}
+		return new(big.Rat).SetFrac(num, denom), nil
+	}
+
+	if c > 6 {
+		return nil, &TypeError{ fmt.Sprintf("Bad big.Float header %d", c) }
+	}
+	var neg = (c - 1) % 2 == 1
+	var form = (c - 1) / 2
+
+	prec, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		return nil, readError("big.Float precision", err)
+	}
+	if prec > big.MaxPrec {
+		return nil, &TypeError{ fmt.Sprintf("Bad big.Float precision %d", prec) }
+	}
+	mode, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, readError("big.Float rounding mode", err)
+	}
+	if big.RoundingMode(mode) > big.ToPositiveInf {
+		return nil, &TypeError{ fmt.Sprintf("Bad big.Float rounding mode %d", mode) }
+	}
+
+	var f = new(big.Float).SetPrec(uint(prec)).SetMode(big.RoundingMode(mode))
+	switch form {
+	case 1:
+		exp, err := binary.ReadVarint(d.reader)
+		if err != nil {
+			return nil, readError("big.Float exponent", err)
+		}
+		if exp < math.MinInt32 || exp > math.MaxInt32 {
+			return nil, &TypeError{ fmt.Sprintf("Bad big.Float exponent %d", exp) }
+		}
+		mant, err := d.readMagnitude()
+		if err != nil {
+			return nil, err
+		}
+		f.SetInt(mant)
+		f.SetMantExp(f, int(exp) - int(prec))
+	case 2:
+		f.SetInf(false)
+	}
+	if neg {
+		f.Neg(f)
+	}
+	return f, nil
+}
@@ -0,0 +1,179 @@
+package spack
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type bigInvoice struct {
+	Total *big.Int
+	Rate big.Rat
+	Scale *big.Float
+	Parts []*big.Int
+	Credit *big.Int `spack:"default=-12345678901234567890"`
+}
+
+func TestBigNumbers(test *testing.T) {
+	var spec = MakeTypeSpec(bigInvoice{})
+
+	var total, _ = new(big.Int).SetString("-123456789012345678901234567890", 10)
+	var scale = new(big.Float).SetPrec(200).SetMode(big.ToZero)
+	scale.SetString("3.14159265358979323846264338327950288")
+
+	var inv = bigInvoice{
+		Total: total,
+		Rate: *big.NewRat(-7, 12),
+		Scale: scale,
+		Parts: []*big.Int{ big.NewInt(0), nil, big.NewInt(1 << 40) },
+	}
+
+	var enc = mustEncode(test, spec, &inv)
+
+	var dec bigInvoice
+	var err = DecodeFromBytes(&dec, spec, enc)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+	if dec.Total.Cmp(total) != 0 || dec.Rate.Cmp(&inv.Rate) != 0 || dec.Credit != nil {
+		test.Errorf("Wrong decode: %v %v %v", dec.Total, &dec.Rate, dec.Credit)
+	}
+	if dec.Scale.Cmp(scale) != 0 || dec.Scale.Prec() != 200 || dec.Scale.Mode() != big.ToZero {
+		test.Errorf("Wrong float: %v %d %v", dec.Scale, dec.Scale.Prec(), dec.Scale.Mode())
+	}
+	if len(dec.Parts) != 3 || dec.Parts[0].Sign() != 0 || dec.Parts[1] != nil || dec.Parts[2].Int64() != 1 << 40 {
+		test.Errorf("Wrong parts: %v", dec.Parts)
+	}
+
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, spec, enc)
+	if err != nil {
+		test.Fatalf("Map decoding error: %v", err)
+	}
+	if decMap["Total"] != total.String() || decMap["Rate"] != "-7/12" || decMap["Credit"] != nil {
+		test.Errorf("Wrong map decode: %v", decMap)
+	}
+	if parts, _ := decMap["Parts"].([]interface{}); len(parts) != 3 || parts[0] != "0" || parts[1] != nil {
+		test.Errorf("Wrong map parts: %v", decMap["Parts"])
+	}
+
+	// Strings and plain numbers are accepted in map mode
+	var src = map[string]interface{}{
+		"Total": "99999999999999999999", "Rate": 3, "Scale": "-Inf", "Parts": []interface{}{ 5 },
+	}
+	enc = mustEncode(test, spec, src)
+	err = DecodeFromBytes(&dec, spec, enc)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+	if dec.Total.String() != "99999999999999999999" || dec.Rate.RatString() != "3" ||
+		!dec.Scale.IsInf() || dec.Scale.Sign() >= 0 || dec.Parts[0].Int64() != 5 {
+		test.Errorf("Wrong decode from map: %v %v %v %v", dec.Total, &dec.Rate, dec.Scale, dec.Parts)
+	}
+	if want, _ := new(big.Int).SetString("-12345678901234567890", 10); dec.Credit.Cmp(want) != 0 {
+		test.Errorf("Wrong default: %v", dec.Credit)
+	}
+
+	_, err = EncodeToBytes(map[string]interface{}{ "Total": "1.5" }, spec)
+	if err == nil {
+		test.Errorf("Non-integer accepted as big.Int")
+	}
+}
+
+func TestBigWrongTarget(test *testing.T) {
+	var spec = MakeTypeSpec((*big.Int)(nil))
+	var enc = mustEncode(test, spec, big.NewInt(42))
+
+	var stringer fmt.Stringer
+	var err = DecodeFromBytes(&stringer, spec, enc)
+	var decErr *DecodeError
+	if !errors.As(err, &decErr) || !strings.Contains(err.Error(), "Can't decode") {
+		test.Errorf("Wrong error decoding into fmt.Stringer: %v", err)
+	}
+
+	var value interface{}
+	if err = DecodeFromBytes(&value, spec, enc); err != nil || value != "42" {
+		test.Errorf("Wrong interface decode: %v %v", err, value)
+	}
+}
+
+func TestBigFloatValues(test *testing.T) {
+	var spec = MakeTypeSpec((*big.Float)(nil))
+
+	var values = []*big.Float{
+		new(big.Float),
+		new(big.Float).Neg(new(big.Float).SetPrec(10)),
+		big.NewFloat(math.Inf(1)),
+		big.NewFloat(-1.5e300),
+		new(big.Float).SetMantExp(big.NewFloat(1), -100000),
+	}
+
+	for _, f := range values {
+		var dec *big.Float
+		var err = DecodeFromBytes(&dec, spec, mustEncode(test, spec, f))
+		if err != nil || dec.Cmp(f) != 0 || dec.Signbit() != f.Signbit() || dec.Prec() != f.Prec() {
+			test.Errorf("Wrong round trip for %v: %v %v", f, err, dec)
+		}
+	}
+}
+
+func TestBigSchema(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("invoice")
+	vt.AddVersion(0, bigInvoice{}, nil)
+
+	var spec = vt.Versions[0].Spec
+	if text := strings.Join(specText(spec), "\n"); !strings.Contains(text, "Total big.Int") || !strings.Contains(text, "Rate big.Rat") {
+		test.Errorf("Wrong spec text:\n%s", text)
+	}
+
+	typ, err := spec.Synthesize()
+	if err != nil {
+		test.Fatalf("Synthesize error: %v", err)
+	}
+	if field, _ := typ.FieldByName("Scale"); field.Type != reflect.TypeOf((*big.Float)(nil)) {
+		test.Errorf("Wrong synthesized type: %v", field.Type)
+	}
+
+	src, err := vt.GenerateSource("billing")
+	if err != nil {
+		test.Fatalf("GenerateSource error: %v", err)
+	}
+	if !strings.Contains(string(src), `import "math/big"`) || !strings.Contains(string(src), "*big.Rat") {
+		test.Errorf("Wrong source:\n%s", src)
+	}
+
+	// Fields stored as strings can't be read as big numbers
+	type Old struct {
+		Total string
+	}
+	if diffs := DiffSpecs(MakeTypeSpec(Old{}), MakeTypeSpec(struct{ Total *big.Int }{})); len(diffs) == 0 {
+		test.Errorf("Kind change not reported")
+	}
+
+	var total, _ = new(big.Int).SetString("1000000000000000000000", 10)
+	enc, err := vt.EncodeObj(&bigInvoice{ Total: total })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+	out, err := vt.ToJSON(enc)
+	if err != nil || !strings.Contains(string(out), `"Total":"1000000000000000000000"`) {
+		test.Errorf("Wrong JSON: %v %s", err, out)
+	}
+
+	back, err := vt.FromJSON([]byte(`{"Total": 1000000000000000000000, "Rate": "1/3", "Parts": []}`))
+	if err != nil {
+		test.Fatalf("FromJSON error: %v", err)
+	}
+	obj, _, err := vt.DecodeObj(back, false)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+	if inv := obj.(*bigInvoice); inv.Total.Cmp(total) != 0 || inv.Rate.RatString() != "1/3" {
+		test.Errorf("Wrong JSON import: %v %v", inv.Total, &inv.Rate)
+	}
+}
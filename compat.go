@@ -0,0 +1,207 @@
+package spack
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DiffSpecs lists every structural difference between two specs, with
+// the field path where it occurs. An empty result means the specs
+// describe the same wire format.
+func DiffSpecs(a *TypeSpec, b *TypeSpec) []string {
+	var d = &specDiff{
+		a: a,
+		b: b,
+		seen: make(map[[2]string]bool),
+	}
+	if a.TrackRefs != b.TrackRefs {
+		d.add("", "reference tracking %v != %v", a.TrackRefs, b.TrackRefs)
+	}
+	d.field("", a.Top, b.Top)
+	return d.diffs
+}
+
+type specDiff struct {
+	a *TypeSpec
+	b *TypeSpec
+	seen map[[2]string]bool
+	diffs []string
+}
+
+func (d *specDiff) add(path string, format string, args ...interface{}) {
+	if path == "" {
+		path = "(top)"
+	}
+	d.diffs = append(d.diffs, path + ": " + fmt.Sprintf(format, args...))
+}
+
+func (d *specDiff) field(path string, x *fieldType, y *fieldType) {
+	if x.Kind != y.Kind {
+		d.add(path, "kind %s != %s", kindName(x.Kind), kindName(y.Kind))
+		return
+	}
+	if x.Flags != y.Flags {
+		d.add(path, "flags [%s] != [%s]", flagsText(x.Flags), flagsText(y.Flags))
+	}
+	if x.Bits != y.Bits {
+		d.add(path, "bits %d != %d", x.Bits, y.Bits)
+	}
+	if !bytes.Equal(x.Default, y.Default) {
+		d.add(path, "default changed")
+	}
+	if strings.Join(x.Rules, ",") != strings.Join(y.Rules, ",") {
+		d.add(path, "rules [%s] != [%s]", strings.Join(x.Rules, " "), strings.Join(y.Rules, " "))
+	}
+	d.enums(path, x.Enum, y.Enum)
+
+	switch reflect.Kind(x.Kind) {
+	case reflect.Slice:
+		d.field(path + "[]", x.Elem[0], y.Elem[0])
+
+	case reflect.Ptr:
+		d.field(path + "*", x.Elem[0], y.Elem[0])
+
+	case reflect.Map:
+		d.field(path + "{key}", x.Elem[0], y.Elem[0])
+		d.field(path + "{}", x.Elem[1], y.Elem[1])
+
+	case STRUCT_REFERENCE:
+		if x.StructName != y.StructName {
+			d.add(path, "struct %s != %s", x.StructName, y.StructName)
+			return
+		}
+		d.structs(path, x.StructName, y.StructName)
+	}
+}
+
+func (d *specDiff) structs(path string, nx string, ny string) {
+	var key = [2]string{ nx, ny }
+	if d.seen[key] {
+		return
+	}
+	d.seen[key] = true
+
+	var sx, sy = d.a.Structs[nx], d.b.Structs[ny]
+	if sx == nil || sy == nil {
+		d.add(path, "struct %s missing from spec", nx)
+		return
+	}
+
+	var prefix = shortStructName(nx)
+
+	if sx.Flags != sy.Flags {
+		d.add(prefix, "flags [%s] != [%s]", flagsText(sx.Flags), flagsText(sy.Flags))
+	}
+
+	for i := 0; i < len(sx.Elem) || i < len(sy.Elem); i++ {
+		if i >= len(sy.Elem) {
+			d.add(prefix + "." + sx.Elem[i].Label, "field removed")
+			continue
+		}
+		if i >= len(sx.Elem) {
+			d.add(prefix + "." + sy.Elem[i].Label, "field added")
+			continue
+		}
+
+		var fx, fy = sx.Elem[i], sy.Elem[i]
+		var fieldPath = prefix + "." + fx.Label
+		if fx.Label != fy.Label {
+			d.add(fieldPath, "field %d label %s != %s", i, fx.Label, fy.Label)
+			continue
+		}
+		if fx.Num != fy.Num {
+			d.add(fieldPath, "field number %d != %d", fx.Num, fy.Num)
+			continue
+		}
+		d.field(fieldPath, fx, fy)
+	}
+}
+
+// enums flags enum values removed or renumbered between specs. Added
+// values don't change what's already encoded, so they're compatible.
+func (d *specDiff) enums(path string, x []EnumValue, y []EnumValue) {
+	for _, ev := range x {
+		var n, ok = enumNumber(y, ev.Name)
+		switch {
+		case !ok:
+			d.add(path, "enum value %s removed", ev.Name)
+		case n != ev.Value:
+			d.add(path, "enum value %s renumbered %d -> %d", ev.Name, ev.Value, n)
+		}
+	}
+}
+
+// FieldNumberConflicts lists field numbers that next uses differently
+// from prev, in structs of the same name: a number given to a field of
+// another type, or a field given a new number. Renaming a numbered
+// field is fine.
+func FieldNumberConflicts(prev *TypeSpec, next *TypeSpec) []string {
+	var out []string
+
+	for name, nextFt := range next.Structs {
+		var prevFt = prev.Structs[name]
+		if prevFt == nil {
+			continue
+		}
+
+		var byNum = make(map[uint16]*fieldType)
+		var byLabel = make(map[string]*fieldType)
+		for _, fieldFt := range prevFt.Elem {
+			if fieldFt.Num != 0 {
+				byNum[fieldFt.Num] = fieldFt
+				byLabel[fieldFt.Label] = fieldFt
+			}
+		}
+
+		var prefix = shortStructName(name)
+		for _, fieldFt := range nextFt.Elem {
+			if fieldFt.Num == 0 {
+				continue
+			}
+			if old := byNum[fieldFt.Num]; old != nil && shapeText(old) != shapeText(fieldFt) {
+				out = append(out, fmt.Sprintf("%s.%s: field number %d was %s %s",
+					prefix, fieldFt.Label, fieldFt.Num, old.Label, shapeText(old)))
+			}
+			if old := byLabel[fieldFt.Label]; old != nil && old.Num != fieldFt.Num {
+				out = append(out, fmt.Sprintf("%s.%s: renumbered from %d to %d",
+					prefix, fieldFt.Label, old.Num, fieldFt.Num))
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+func flagsText(flags uint8) string {
+	var names []string
+	if flags & FLAG_SPARSE != 0 {
+		names = append(names, "sparse")
+	}
+	if flags & FLAG_OPTIONAL != 0 {
+		names = append(names, "optional")
+	}
+	if flags & FLAG_PACKED != 0 {
+		names = append(names, "packed")
+	}
+	return strings.Join(names, " ")
+}
+
+func kindName(kind uint8) string {
+	switch reflect.Kind(kind) {
+	case IGNORED_FIELD:
+		return "ignored"
+	case STRUCT_REFERENCE:
+		return "struct"
+	case BIG_INT:
+		return "big.Int"
+	case BIG_FLOAT:
+		return "big.Float"
+	case BIG_RAT:
+		return "big.Rat"
+	}
+	return reflect.Kind(kind).String()
+}
@@ -0,0 +1,506 @@
+package spack
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Constraints are declared in field tags and stored in the spec as
+// rules, so they hold for map-mode data as well as Go structs:
+//
+//   min=N, max=N    numeric bounds
+//   maxlen=N        string (in runes), slice or map length
+//   nonempty        non-empty string, slice or map; non-nil pointer
+//   oneof=a|b|c     allowed values, for strings and numbers
+//   regex=...       strings; takes the rest of the tag unless quoted
+//
+// Rules on pointer fields apply to what they point at.
+
+var ruleOrder = []string{ "min", "max", "maxlen", "nonempty", "oneof", "regex" }
+
+// tagRules reads a field's constraints, checking they suit its type.
+func tagRules(tag spackTag, ft *fieldType) ([]string, error) {
+	var kind = reflect.Kind(ft.Kind)
+	if kind == reflect.Ptr {
+		kind = reflect.Kind(ft.Elem[0].Kind)
+	}
+
+	var rules []string
+	for _, name := range ruleOrder {
+		var arg, ok = tag[name]
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch name {
+		case "min", "max":
+			if !isIntKind(kind) && !isFloatKind(kind) {
+				err = fmt.Errorf("needs a number, not %v", kind)
+			} else {
+				_, err = strconv.ParseFloat(arg, 64)
+			}
+
+		case "maxlen":
+			if kind != reflect.String && kind != reflect.Slice && kind != reflect.Map {
+				err = fmt.Errorf("needs a string, slice or map, not %v", kind)
+			} else {
+				_, err = strconv.ParseUint(arg, 10, 64)
+			}
+
+		case "nonempty":
+			if kind != reflect.String && kind != reflect.Slice && kind != reflect.Map && reflect.Kind(ft.Kind) != reflect.Ptr {
+				err = fmt.Errorf("needs a string, slice, map or pointer, not %v", kind)
+			}
+
+		case "oneof":
+			if kind != reflect.String && !isIntKind(kind) && !isFloatKind(kind) {
+				err = fmt.Errorf("needs a string or number, not %v", kind)
+			}
+
+		case "regex":
+			if kind != reflect.String {
+				err = fmt.Errorf("needs a string, not %v", kind)
+			} else {
+				_, err = compileRule(arg)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if name == "nonempty" {
+			rules = append(rules, name)
+		} else {
+			rules = append(rules, name + "=" + arg)
+		}
+	}
+
+	return rules, nil
+}
+
+var ruleRegexps sync.Map
+
+func compileRule(pattern string) (*regexp.Regexp, error) {
+	if re, ok := ruleRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	var re, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	ruleRegexps.Store(pattern, re)
+	return re, nil
+}
+
+// -------------------------------
+
+type ValidationError struct {
+	Violations []Violation
+}
+
+type Violation struct {
+	// Path is the field path, e.g. "User.Addresses[1].Zip"
+	Path string
+	Rule string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	var lines = make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		lines = append(lines, fmt.Sprintf("%s: %s (%s)", v.Path, v.Message, v.Rule))
+	}
+	return "Validation failed:\n  " + strings.Join(lines, "\n  ")
+}
+
+// Validate checks a Go value or map-mode object against the spec's
+// constraints, returning a *ValidationError listing every violation.
+func (ts *TypeSpec) Validate(obj interface{}) error {
+	if !ts.hasRules() {
+		return nil
+	}
+
+	var v = &validator{ spec: ts, structs: ts.Structs }
+	v.value("", reflect.ValueOf(obj), ts.Top)
+
+	if len(v.violations) > 0 {
+		sort.SliceStable(v.violations, func(i, j int) bool {
+			return v.violations[i].Path < v.violations[j].Path
+		})
+		return &ValidationError{ v.violations }
+	}
+	return nil
+}
+
+// hasRules reports whether any field of the spec has constraints.
+func (ts *TypeSpec) hasRules() bool {
+	if ts.Top.hasRules() {
+		return true
+	}
+	for _, structFt := range ts.Structs {
+		if structFt.hasRules() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ft *fieldType) hasRules() bool {
+	if len(ft.Rules) > 0 {
+		return true
+	}
+	for _, elem := range ft.Elem {
+		if elem.hasRules() {
+			return true
+		}
+	}
+	return false
+}
+
+type validator struct {
+	spec *TypeSpec
+	structs structMap
+	violations []Violation
+	// visited stops shared and cyclic references being walked twice
+	visited map[visitKey]bool
+}
+
+type visitKey struct {
+	ptr uintptr
+	name string
+	n int
+}
+
+// visit reports whether a struct value hasn't been seen yet, marking it
+// seen. Structs are keyed by address and name, since a struct and its
+// first field share an address.
+func (v *validator) visit(val reflect.Value, name string) bool {
+	val = reflect.Indirect(val)
+	var ptr uintptr
+	switch {
+	case val.Kind() == reflect.Map:
+		ptr = val.Pointer()
+	case val.CanAddr():
+		ptr = val.Addr().Pointer()
+	default:
+		return true
+	}
+
+	return v.mark(visitKey{ ptr, name, 0 })
+}
+
+// visitContainer is visit for slices and maps, whose elements needn't be
+// addressable. Slices of one array are told apart by length.
+func (v *validator) visitContainer(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Slice, reflect.Map:
+	default:
+		return true
+	}
+	if val.Len() == 0 {
+		return true
+	}
+	return v.mark(visitKey{ val.Pointer(), val.Type().String(), val.Len() })
+}
+
+func (v *validator) mark(key visitKey) bool {
+	if v.visited[key] {
+		return false
+	}
+	if v.visited == nil {
+		v.visited = map[visitKey]bool{}
+	}
+	v.visited[key] = true
+	return true
+}
+
+func (v *validator) fail(path string, rule string, format string, args ...interface{}) {
+	if path == "" {
+		path = "(top)"
+	}
+	v.violations = append(v.violations, Violation{ path, rule, fmt.Sprintf(format, args...) })
+}
+
+func (v *validator) value(path string, val reflect.Value, ft *fieldType) {
+	for val.IsValid() && val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return
+	}
+
+	switch reflect.Kind(ft.Kind) {
+	case reflect.Slice:
+		if !v.visitContainer(val) {
+			return
+		}
+		for i := 0; i < val.Len(); i++ {
+			v.value(fmt.Sprintf("%s[%d]", path, i), val.Index(i), ft.Elem[0])
+		}
+
+	case reflect.Map:
+		if !v.visitContainer(val) {
+			return
+		}
+		var iter = val.MapRange()
+		for iter.Next() {
+			v.value(fmt.Sprintf("%s{%v}", path, iter.Key()), iter.Value(), ft.Elem[1])
+		}
+
+	case reflect.Ptr:
+		if val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return
+			}
+			val = val.Elem()
+		}
+		v.value(path, val, ft.Elem[0])
+
+	case STRUCT_REFERENCE:
+		if v.visit(val, ft.StructName) {
+			v.structFields(path, val, ft.StructName)
+		}
+	}
+}
+
+func (v *validator) structFields(path string, val reflect.Value, name string) {
+	val = reflect.Indirect(val)
+	var structFt = v.structs[name]
+	if structFt == nil || !val.IsValid() {
+		return
+	}
+
+	var prefix = path
+	if prefix == "" {
+		prefix = shortStructName(name)
+	}
+
+	var mapVal, isMap = val.Interface().(map[string]interface{})
+	var binding *structBinding
+	if !isMap {
+		var err error
+		binding, err = bindStruct(val.Type(), name, v.spec)
+		if err != nil {
+			// Encoding reports this
+			return
+		}
+	}
+
+	for i, fieldFt := range structFt.Elem {
+		if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			continue
+		}
+
+		var fieldPath = prefix + "." + fieldFt.Label
+		var fieldVal reflect.Value
+
+		if isMap {
+			var raw, ok = mapVal[fieldFt.Label]
+			if !ok {
+				// Absent tracked fields aren't encoded; others get
+				// their default
+				if structFt.Flags & FLAG_SPARSE != 0 || fieldFt.Flags & FLAG_OPTIONAL != 0 {
+					continue
+				}
+				raw, _ = defaultMapValue(fieldFt, v.structs)
+			}
+			fieldVal = reflect.ValueOf(raw)
+		} else {
+			if binding.fields[i] == nil {
+				continue
+			}
+			fieldVal = fieldForRead(val, binding.fields[i])
+		}
+
+		v.rules(fieldPath, fieldVal, fieldFt)
+		v.value(fieldPath, fieldVal, fieldFt)
+	}
+}
+
+func (v *validator) rules(path string, val reflect.Value, ft *fieldType) {
+	for val.IsValid() && val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+
+	for _, rule := range ft.Rules {
+		var name, arg, _ = strings.Cut(rule, "=")
+
+		if name == "nonempty" {
+			if isEmpty(val) {
+				v.fail(path, rule, "is empty")
+			}
+			continue
+		}
+
+		var target = val
+		if target.IsValid() && target.Kind() == reflect.Ptr {
+			if target.IsNil() {
+				continue
+			}
+			target = target.Elem()
+		}
+		if !target.IsValid() {
+			continue
+		}
+		target = enumTarget(target, ft)
+
+		switch name {
+		case "min", "max":
+			var cmp, ok = compareBound(target, arg)
+			if ok && name == "min" && cmp < 0 {
+				v.fail(path, rule, "%v is less than %s", target, arg)
+			}
+			if ok && name == "max" && cmp > 0 {
+				v.fail(path, rule, "%v is more than %s", target, arg)
+			}
+
+		case "maxlen":
+			var limit, _ = strconv.Atoi(arg)
+			var length int
+			switch target.Kind() {
+			case reflect.String:
+				length = utf8.RuneCountInString(target.String())
+			case reflect.Slice, reflect.Map:
+				length = target.Len()
+			}
+			if length > limit {
+				v.fail(path, rule, "length %d is more than %d", length, limit)
+			}
+
+		case "oneof":
+			var found = false
+			for _, opt := range strings.Split(arg, "|") {
+				if target.Kind() == reflect.String {
+					found = target.String() == opt
+				} else {
+					var cmp, ok = compareBound(target, opt)
+					found = ok && cmp == 0
+				}
+				if found {
+					break
+				}
+			}
+			if !found {
+				v.fail(path, rule, "%q is not one of %s", fmt.Sprint(target), arg)
+			}
+
+		case "regex":
+			var re, err = compileRule(arg)
+			if err == nil && target.Kind() == reflect.String && !re.MatchString(target.String()) {
+				v.fail(path, rule, "%q doesn't match", target.String())
+			}
+		}
+	}
+}
+
+func isEmpty(val reflect.Value) bool {
+	if !val.IsValid() {
+		return true
+	}
+	switch val.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return val.Len() == 0
+	case reflect.Ptr:
+		return val.IsNil()
+	}
+	return false
+}
+
+func numberOf(val reflect.Value) (float64, bool) {
+	switch {
+	case val.CanInt():
+		return float64(val.Int()), true
+	case val.CanUint():
+		return float64(val.Uint()), true
+	case val.CanFloat():
+		return val.Float(), true
+	}
+	return 0, false
+}
+
+// enumTarget turns a map-mode enum name back into its number, so
+// numeric rules apply to it.
+func enumTarget(val reflect.Value, ft *fieldType) reflect.Value {
+	if reflect.Kind(ft.Kind) == reflect.Ptr {
+		ft = ft.Elem[0]
+	}
+	if val.Kind() != reflect.String || ft.Enum == nil {
+		return val
+	}
+	if n, ok := enumNumber(ft.Enum, val.String()); ok {
+		return reflect.ValueOf(n)
+	}
+	return val
+}
+
+// compareBound compares a number with a rule's bound, as integers when
+// both are, so values beyond 2^53 aren't rounded. It fails if val isn't
+// a number or the bound doesn't parse.
+func compareBound(val reflect.Value, arg string) (int, bool) {
+	switch {
+	case val.CanFloat():
+		var bound, err = strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, false
+		}
+		return compareFloats(val.Float(), bound), true
+
+	case val.CanInt():
+		if bound, err := strconv.ParseInt(arg, 10, 64); err == nil {
+			return compareInts(val.Int(), bound), true
+		}
+		return compareRat(new(big.Rat).SetInt64(val.Int()), arg)
+
+	case val.CanUint():
+		if bound, err := strconv.ParseUint(arg, 10, 64); err == nil {
+			switch {
+			case val.Uint() < bound:
+				return -1, true
+			case val.Uint() > bound:
+				return 1, true
+			}
+			return 0, true
+		}
+		return compareRat(new(big.Rat).SetInt(new(big.Int).SetUint64(val.Uint())), arg)
+	}
+	return 0, false
+}
+
+// compareRat handles bounds that aren't integers of the value's kind,
+// like "1.5" or "-1" for unsigned values.
+func compareRat(n *big.Rat, arg string) (int, bool) {
+	var bound, ok = new(big.Rat).SetString(arg)
+	if !ok {
+		return 0, false
+	}
+	return n.Cmp(bound), true
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,230 @@
+package spack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type constrainedAddress struct {
+	Zip string `spack:"regex=^[0-9]{5}$"`
+}
+
+type constrainedUser struct {
+	Name string `spack:"nonempty,maxlen=5"`
+	Age uint8 `spack:"min=18,max=120"`
+	Role string `spack:"oneof=admin|user"`
+	Homes []constrainedAddress `spack:"maxlen=2"`
+	Score *float32 `spack:"max=1"`
+}
+
+func TestValidate(test *testing.T) {
+	var spec = MakeTypeSpec(constrainedUser{})
+
+	var score float32 = 0.5
+	var good = constrainedUser{ "ann", 30, "user", []constrainedAddress{ { "12345" } }, &score }
+	if err := spec.Validate(&good); err != nil {
+		test.Errorf("Valid user rejected: %v", err)
+	}
+
+	score = 2
+	var bad = constrainedUser{ "", 7, "root", []constrainedAddress{ { "1" }, { "2" }, { "33333" } }, &score }
+	var err = spec.Validate(&bad)
+
+	var verr, ok = err.(*ValidationError)
+	if !ok {
+		test.Fatalf("Wrong error: %v", err)
+	}
+
+	var paths []string
+	for _, v := range verr.Violations {
+		paths = append(paths, v.Path + " " + v.Rule)
+	}
+
+	var want = []string{
+		"constrainedUser.Age min=18",
+		"constrainedUser.Homes maxlen=2",
+		"constrainedUser.Homes[0].Zip regex=^[0-9]{5}$",
+		"constrainedUser.Homes[1].Zip regex=^[0-9]{5}$",
+		"constrainedUser.Name nonempty",
+		"constrainedUser.Role oneof=admin|user",
+		"constrainedUser.Score max=1",
+	}
+	if strings.Join(paths, "\n") != strings.Join(want, "\n") {
+		test.Errorf("Wrong violations:\n%s", strings.Join(paths, "\n"))
+	}
+
+	// Map-mode objects are held to the same rules
+	var obj = map[string]interface{}{ "Name": "toolongname", "Age": 40, "Role": "admin" }
+	err = spec.Validate(obj)
+	if err == nil || !strings.Contains(err.Error(), "constrainedUser.Name: length 11 is more than 5") {
+		test.Errorf("Map object not validated: %v", err)
+	}
+
+	type Bad struct {
+		Name string `spack:"min=3"`
+	}
+	_, err = MakeTypeSpecWithOptions(Bad{}, SpecOptions{})
+	if err == nil {
+		test.Errorf("Numeric constraint allowed on string")
+	}
+}
+
+func TestValidateObj(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("constrained")
+	vt.AddVersion(0, constrainedUser{}, nil)
+
+	_, err := vt.EncodeObj(&constrainedUser{ Name: "bob", Age: 3, Role: "user" })
+	if _, ok := err.(*ValidationError); !ok {
+		test.Errorf("EncodeObj didn't validate: %v", err)
+	}
+
+	// Data written before a constraint existed
+	var enc = append([]byte{ 0, 0 }, mustEncode(test, MakeTypeSpec(constrainedUser{}),
+		map[string]interface{}{ "Name": "bob", "Age": 3, "Role": "user" })...)
+
+	_, _, err = vt.DecodeObj(enc, false)
+	if err != nil {
+		test.Errorf("Decode validated without ValidateOnDecode: %v", err)
+	}
+
+	vt.ValidateOnDecode = true
+	_, _, err = vt.DecodeObj(enc, false)
+	if _, ok := err.(*ValidationError); !ok {
+		test.Errorf("DecodeObj didn't validate: %v", err)
+	}
+}
+
+func mustEncode(test *testing.T, spec *TypeSpec, obj interface{}) []byte {
+	var enc, err = EncodeToBytes(obj, spec)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+	return enc
+}
+
+type ruledLevel uint8
+
+func (l ruledLevel) String() string {
+	return [...]string{ "low", "mid", "high" }[l]
+}
+
+func (ruledLevel) EnumNames() map[int64]string {
+	return map[int64]string{ 0: "low", 1: "mid", 2: "high" }
+}
+
+func TestValidateNumbers(test *testing.T) {
+	type Limits struct {
+		Level ruledLevel `spack:"oneof=1|2"`
+		Big int64 `spack:"max=9007199254740993"`
+		Huge uint64 `spack:"min=18446744073709551615"`
+	}
+	var spec = MakeTypeSpec(Limits{})
+
+	var good = Limits{ 2, 9007199254740993, 18446744073709551615 }
+	if err := spec.Validate(&good); err != nil {
+		test.Errorf("Valid limits rejected: %v", err)
+	}
+
+	// Map-mode enums hold names, checked by number
+	var obj = map[string]interface{}{ "Level": "mid", "Big": int64(1), "Huge": uint64(18446744073709551615) }
+	if err := spec.Validate(obj); err != nil {
+		test.Errorf("Valid map limits rejected: %v", err)
+	}
+
+	// Both are equal to their bound as float64
+	var bad = Limits{ 0, 9007199254740994, 18446744073709551614 }
+	var err = spec.Validate(&bad)
+	var verr, ok = err.(*ValidationError)
+	if !ok || len(verr.Violations) != 3 {
+		test.Fatalf("Wrong error: %v", err)
+	}
+}
+
+type ruledNode struct {
+	Name string `spack:"nonempty"`
+	Next *ruledNode
+}
+
+func TestValidateCycles(test *testing.T) {
+	var spec, err = MakeTypeSpecWithOptions(ruledNode{}, SpecOptions{ TrackRefs: true })
+	if err != nil {
+		test.Fatalf("Spec error: %v", err)
+	}
+
+	var a = &ruledNode{ Name: "a" }
+	a.Next = &ruledNode{ Name: "", Next: a }
+
+	err = spec.Validate(a)
+	var verr, ok = err.(*ValidationError)
+	if !ok || len(verr.Violations) != 1 || verr.Violations[0].Path != "ruledNode.Next.Name" {
+		test.Fatalf("Wrong cyclic violations: %v", err)
+	}
+
+	var obj = map[string]interface{}{ "Name": "" }
+	obj["Next"] = obj
+	if err = spec.Validate(obj); err == nil {
+		test.Errorf("Cyclic map object not validated")
+	}
+
+	// Rejected objects leave the buffer's spare capacity alone
+	var vt = NewTypeSet().RegisterType("node")
+	vt.AddVersionObj(&Version{ Version: 1, Spec: spec })
+
+	var buf = make([]byte, 1, 64)
+	var enc []byte
+	enc, err = vt.AppendObj(buf, a)
+	if _, ok := err.(*ValidationError); !ok || len(enc) != 1 || buf[:2][1] != 0 {
+		test.Errorf("Rejected object written: %v %x", err, buf[:8])
+	}
+
+	a.Next.Name = "b"
+	enc, err = vt.AppendObj(buf, a)
+	if err != nil || len(enc) < 3 {
+		test.Errorf("Valid cyclic object rejected: %v", err)
+	}
+}
+
+func TestGreedyTagOptions(test *testing.T) {
+	// An unquoted default would swallow the rule
+	type Swallowed struct {
+		Code string `spack:"default=abc,regex=^[a-z]+$"`
+	}
+	var _, err = MakeTypeSpecWithOptions(Swallowed{}, SpecOptions{})
+	if err == nil || !strings.Contains(err.Error(), "regex") {
+		test.Errorf("Swallowed rule accepted: %v", err)
+	}
+
+	type Quoted struct {
+		Code string `spack:"default=\"a,b\",regex=^[a-z,]+$"`
+		Name string `spack:"regex=\"^[a-z]{1,3}$\",default=abc"`
+	}
+	spec, err := MakeTypeSpecWithOptions(Quoted{}, SpecOptions{})
+	if err != nil {
+		test.Fatalf("Quoted options refused: %v", err)
+	}
+	var fields = spec.Structs[spec.Top.StructName].Elem
+	if text, _ := defaultTagText(fields[0]); text != "a,b" || len(fields[0].Rules) != 1 || fields[0].Rules[0] != "regex=^[a-z,]+$" {
+		test.Errorf("Wrong quoted options: %q %v", text, fields[0].Rules)
+	}
+	if text, _ := defaultTagText(fields[1]); text != "abc" || len(fields[1].Rules) != 1 || fields[1].Rules[0] != "regex=^[a-z]{1,3}$" {
+		test.Errorf("Wrong quoted options: %q %v", text, fields[1].Rules)
+	}
+
+	// Synthesized tags quote them the same way
+	typ, err := spec.Synthesize()
+	if err != nil {
+		test.Fatalf("Synthesize error: %v", err)
+	}
+	if diffs := DiffSpecs(spec, MakeTypeSpec(reflect.Zero(typ).Interface())); len(diffs) > 0 {
+		test.Errorf("Synthesized options differ: %v", diffs)
+	}
+
+	type BadQuote struct {
+		Code string `spack:"default=\"abc\"x"`
+	}
+	if _, err = MakeTypeSpecWithOptions(BadQuote{}, SpecOptions{}); err == nil {
+		test.Errorf("Bad quoting accepted")
+	}
+}
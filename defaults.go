@@ -0,0 +1,227 @@
+package spack
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Field defaults come from `spack:"default=..."`. Numbers, bools and
+// strings are written in the tag; anything else (slices, maps, structs)
+// is registered with RegisterDefault and referenced as "default=@name".
+//
+// The spec records each default encoded in the field's own type. It's
+// used for map entries missing from map-mode objects, and filled in
+// by AutoUpgrader. Go fields missing from the spec being decoded, as
+// when reading older versions, get their tag default.
+
+var registeredDefaults = struct {
+	sync.RWMutex
+	values map[string]interface{}
+}{ values: make(map[string]interface{}) }
+
+func RegisterDefault(name string, value interface{}) {
+	registeredDefaults.Lock()
+	defer registeredDefaults.Unlock()
+	registeredDefaults.values[name] = value
+}
+
+// defaultValue makes the default described by a tag as a value of typ.
+func defaultValue(text string, typ reflect.Type) (reflect.Value, error) {
+	if strings.HasPrefix(text, "@") {
+		registeredDefaults.RLock()
+		var value, ok = registeredDefaults.values[text[1:]]
+		registeredDefaults.RUnlock()
+
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("no default registered as %s", text[1:])
+		}
+
+		var val = reflect.ValueOf(value)
+		switch {
+		case val.Type().AssignableTo(typ):
+			return val, nil
+		case val.Type().ConvertibleTo(typ):
+			return val.Convert(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("default %s is a %v, not %v", text[1:], val.Type(), typ)
+	}
+
+	var out = reflect.New(typ).Elem()
+	var err error
+
+	if kind, ok := bigKindOf(typ); ok {
+		var ptr, err = parseBig(text, kind)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("bad %v default %q", typ, text)
+		}
+		if typ.Kind() == reflect.Ptr {
+			return reflect.ValueOf(ptr), nil
+		}
+		return reflect.ValueOf(ptr).Elem(), nil
+	}
+
+	switch kind := typ.Kind(); {
+	case kind >= reflect.Int8 && kind <= reflect.Int64:
+		var n int64
+		n, err = strconv.ParseInt(text, 0, typ.Bits())
+		out.SetInt(n)
+
+	case kind >= reflect.Uint8 && kind <= reflect.Uint64:
+		var n uint64
+		n, err = strconv.ParseUint(text, 0, typ.Bits())
+		out.SetUint(n)
+
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(text, typ.Bits())
+		out.SetFloat(f)
+
+	case kind == reflect.Complex64 || kind == reflect.Complex128:
+		var c complex128
+		c, err = strconv.ParseComplex(text, typ.Bits())
+		out.SetComplex(c)
+
+	case kind == reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(text)
+		out.SetBool(b)
+
+	case kind == reflect.String:
+		out.SetString(text)
+
+	case kind == reflect.Ptr:
+		var elem, err = defaultValue(text, typ.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.Set(reflect.New(typ.Elem()))
+		out.Elem().Set(elem)
+
+	default:
+		return reflect.Value{}, fmt.Errorf("%v defaults must be registered (default=@name)", typ)
+	}
+
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("bad %v default %q", typ, text)
+	}
+	return out, nil
+}
+
+// defaultMapValue decodes a field's default in map mode, or gives the
+// zero value for its type if it has none.
+func defaultMapValue(ft *fieldType, structs structMap) (interface{}, error) {
+	if ft.Default == nil {
+		return zeroMapValue(ft), nil
+	}
+
+	var target = createMapValue(ft)
+	var err = DecodeFromBytes(target, &TypeSpec{ Structs: structs, Top: ft }, ft.Default)
+	if err != nil || target == nil {
+		return nil, err
+	}
+	return reflect.ValueOf(target).Elem().Interface(), nil
+}
+
+func zeroMapValue(ft *fieldType) interface{} {
+	var kind = reflect.Kind(ft.Kind)
+	if typ, ok := kindTypes[kind]; ok {
+		return reflect.Zero(typ).Interface()
+	}
+
+	switch kind {
+	case reflect.Slice:
+		if isByteSlice(ft) {
+			return []byte{}
+		}
+		return []interface{}{}
+	case reflect.Map:
+		return map[interface{}]interface{}{}
+	case STRUCT_REFERENCE:
+		return map[string]interface{}{}
+	}
+	return nil
+}
+
+// AutoUpgrader upgrades objects of the previous version to version in
+// map mode, filling fields the new version added with their defaults;
+// DecodeObj converts the result to the version's exemplar type.
+// The spec is looked up when the upgrader runs, so it can be passed
+// when adding the version:
+//
+//   vt.AddVersion(2, UserV2{}, vt.AutoUpgrader(2))
+func (vt *VersionedType) AutoUpgrader(version uint16) UpgradeFunc {
+	return func(obj interface{}) (interface{}, error) {
+		var v = vt.GetVersion(version)
+		if v == nil {
+			return nil, &TypeError{ fmt.Sprintf("Version not registered: %d", version) }
+		}
+
+		var out, err = toMap(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		if reflect.Kind(v.Spec.Top.Kind) != STRUCT_REFERENCE {
+			return nil, &TypeError{ fmt.Sprintf("Can't auto-upgrade to non-struct version %d", version) }
+		}
+
+		err = fillDefaults(out, v.Spec.Top.StructName, v.Spec.Structs)
+		if err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+}
+
+func fillDefaults(obj map[string]interface{}, name string, structs structMap) error {
+	var structFt = structs[name]
+	if structFt == nil {
+		return &TypeError{ fmt.Sprintf("No such struct in spec: %s", name) }
+	}
+
+	for _, fieldFt := range structFt.Elem {
+		if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			continue
+		}
+
+		var val, ok = obj[fieldFt.Label]
+		if !ok {
+			// Presence-tracked fields are better left absent
+			if structFt.Flags & FLAG_SPARSE != 0 || fieldFt.Flags & FLAG_OPTIONAL != 0 {
+				continue
+			}
+			def, err := defaultMapValue(fieldFt, structs)
+			if err != nil {
+				return &TypeError{ fmt.Sprintf("Bad default for %s.%s: %v", name, fieldFt.Label, err) }
+			}
+			obj[fieldFt.Label] = def
+			continue
+		}
+
+		if nested, isMap := val.(map[string]interface{}); isMap && reflect.Kind(fieldFt.Kind) == STRUCT_REFERENCE {
+			var err = fillDefaults(nested, fieldFt.StructName, structs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// defaultTagText renders a scalar default as it would be written in a
+// tag; false for defaults that have to be registered.
+func defaultTagText(ft *fieldType) (string, bool) {
+	var _, scalar = kindTypes[reflect.Kind(ft.Kind)]
+	if !(scalar || isBigKind(reflect.Kind(ft.Kind))) || ft.Default == nil {
+		return "", false
+	}
+	var val, err = defaultMapValue(ft, nil)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprint(val), true
+}
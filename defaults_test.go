@@ -0,0 +1,123 @@
+package spack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagDefaults(test *testing.T) {
+	type Settings struct {
+		Name string `spack:"default=unnamed, really"`
+		Retries uint8 `spack:"default=3"`
+		Ratio float32 `spack:"default=0.5"`
+		Enabled bool `spack:"default=true"`
+		Plain int32
+	}
+
+	var ft = MakeTypeSpec(Settings{})
+
+	// Missing map entries get their defaults, or zero values
+	var src = map[string]interface{}{ "Retries": 5 }
+	enc, err := EncodeToBytes(&src, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec Settings
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec != (Settings{ "unnamed, really", 5, 0.5, true, 0 }) {
+		test.Errorf("Map defaults not applied: %v %#v", err, dec)
+	}
+
+	type Bad struct {
+		Count uint8 `spack:"default=300"`
+	}
+	_, err = MakeTypeSpecWithOptions(Bad{}, SpecOptions{})
+	if err == nil {
+		test.Errorf("Out of range default allowed")
+	}
+}
+
+func TestRegisteredDefaults(test *testing.T) {
+	type Point struct {
+		X, Y int16
+	}
+
+	RegisterDefault("test_tags", []string{ "a", "b" })
+	RegisterDefault("test_origin", Point{ 1, 2 })
+
+	type Shape struct {
+		Tags []string `spack:"default=@test_tags"`
+		Origin Point `spack:"default=@test_origin"`
+	}
+
+	var ft = MakeTypeSpec(Shape{})
+
+	enc, err := EncodeToBytes(&map[string]interface{}{}, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec Shape
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || !reflect.DeepEqual(dec, Shape{ []string{ "a", "b" }, Point{ 1, 2 } }) {
+		test.Errorf("Registered defaults not applied: %v %#v", err, dec)
+	}
+
+	type Missing struct {
+		Tags []string `spack:"default=@test_nothing"`
+	}
+	_, err = MakeTypeSpecWithOptions(Missing{}, SpecOptions{})
+	if err == nil {
+		test.Errorf("Unregistered default allowed")
+	}
+}
+
+func TestDefaultsForOlderVersions(test *testing.T) {
+	type v0 struct {
+		_ struct{} `spack:"name=account"`
+		Name string
+	}
+
+	type v1 struct {
+		_ struct{} `spack:"name=account"`
+		Name string
+		Plan string `spack:"default=free"`
+		Seats uint16 `spack:"default=1"`
+	}
+
+	var old = MakeTypeSpec(v0{})
+	enc, err := EncodeToBytes(&v0{ Name: "acme" }, old)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec v1
+	err = DecodeFromBytes(&dec, old, enc)
+	if err != nil || dec.Name != "acme" || dec.Plan != "free" || dec.Seats != 1 {
+		test.Errorf("Defaults not applied to older version: %v %#v", err, dec)
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("account")
+	vt.AddVersion(0, v0{}, nil)
+
+	obj, err := vt.EncodeObj(&v0{ Name: "acme" })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	vt.AddVersion(1, v1{}, vt.AutoUpgrader(1))
+
+	decIF, upgraded, err := vt.DecodeObj(obj, true)
+	var decMap, _ = decIF.(map[string]interface{})
+	if err != nil || !upgraded || decMap["Name"] != "acme" || decMap["Plan"] != "free" || decMap["Seats"] != uint16(1) {
+		test.Errorf("AutoUpgrader didn't fill defaults: %v %v", err, decIF)
+	}
+
+	decIF, _, err = vt.DecodeObj(obj, false)
+	var decObj, _ = decIF.(*v1)
+	if err != nil || decObj == nil || decObj.Name != "acme" || decObj.Plan != "free" || decObj.Seats != 1 {
+		test.Errorf("AutoUpgrader result not typed: %v %v", err, decIF)
+	}
+}
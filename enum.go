@@ -0,0 +1,121 @@
+package spack
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Enum is implemented by integer types with symbolic names. The names
+// are stored in the spec, so map-mode and JSON output can show them
+// and imports can use them. Types that can't implement it can call
+// RegisterEnum instead.
+type Enum interface {
+	EnumNames() map[int64]string
+}
+
+type EnumValue struct {
+	Value int64
+	Name string
+}
+
+var registeredEnums = struct {
+	sync.RWMutex
+	names map[reflect.Type]map[int64]string
+}{ names: make(map[reflect.Type]map[int64]string) }
+
+func RegisterEnum(exemplar interface{}, names map[int64]string) {
+	registeredEnums.Lock()
+	defer registeredEnums.Unlock()
+	registeredEnums.names[reflect.TypeOf(exemplar)] = names
+}
+
+var enumType = reflect.TypeOf((*Enum)(nil)).Elem()
+
+// enumValues lists the names of an integer type, sorted by value, or
+// nil if it has none.
+func enumValues(typ reflect.Type) []EnumValue {
+	if !isIntKind(typ.Kind()) {
+		return nil
+	}
+
+	registeredEnums.RLock()
+	var names, ok = registeredEnums.names[typ]
+	registeredEnums.RUnlock()
+
+	if !ok && typ.Implements(enumType) {
+		names = reflect.Zero(typ).Interface().(Enum).EnumNames()
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	var out = make([]EnumValue, 0, len(names))
+	for value, name := range names {
+		out = append(out, EnumValue{ value, name })
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Value < out[j].Value })
+	return out
+}
+
+func enumName(values []EnumValue, value int64) (string, bool) {
+	for _, ev := range values {
+		if ev.Value == value {
+			return ev.Name, true
+		}
+	}
+	return "", false
+}
+
+func enumNumber(values []EnumValue, name string) (int64, bool) {
+	for _, ev := range values {
+		if ev.Name == name {
+			return ev.Value, true
+		}
+	}
+	return 0, false
+}
+
+// enumMapValue renders a decoded integer by name, for map mode.
+// Values without a name stay numbers.
+func enumMapValue(val reflect.Value, ft *fieldType) reflect.Value {
+	if ft.Enum == nil {
+		return val
+	}
+	var n, ok = intOf(val)
+	if !ok {
+		return val
+	}
+	if name, ok := enumName(ft.Enum, n); ok {
+		return reflect.ValueOf(name)
+	}
+	return val
+}
+
+// enumFromName turns a map-mode name back into a value of the field's
+// kind.
+func enumFromName(val reflect.Value, ft *fieldType) (reflect.Value, error) {
+	if val.Kind() != reflect.String || ft.Enum == nil {
+		return val, nil
+	}
+	var n, ok = enumNumber(ft.Enum, val.String())
+	if !ok {
+		return reflect.Value{}, &TypeError{ fmt.Sprintf("Unknown enum name %q", val.String()) }
+	}
+	return reflect.ValueOf(n).Convert(kindTypes[reflect.Kind(ft.Kind)]), nil
+}
+
+func intOf(val reflect.Value) (int64, bool) {
+	for val.IsValid() && val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	switch {
+	case !val.IsValid():
+	case val.CanInt():
+		return val.Int(), true
+	case val.CanUint():
+		return int64(val.Uint()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,141 @@
+package spack
+
+import (
+	"strings"
+	"testing"
+)
+
+type testColor uint8
+
+func (testColor) EnumNames() map[int64]string {
+	return map[int64]string{ 0: "red", 1: "green", 2: "blue" }
+}
+
+type testSize int16
+
+func TestEnumSpec(test *testing.T) {
+	RegisterEnum(testSize(0), map[int64]string{ -1: "small", 1: "large" })
+
+	type Shirt struct {
+		Color testColor
+		Size testSize
+		Trim []testColor
+	}
+
+	var ft = MakeTypeSpec(Shirt{})
+	var fields = ft.Structs[ft.Top.StructName].Elem
+
+	if len(fields[0].Enum) != 3 || fields[0].Enum[2] != (EnumValue{ 2, "blue" }) {
+		test.Errorf("Enum interface names not stored: %v", fields[0].Enum)
+	}
+	if len(fields[1].Enum) != 2 || fields[1].Enum[0] != (EnumValue{ -1, "small" }) {
+		test.Errorf("Registered enum names not stored: %v", fields[1].Enum)
+	}
+
+	enc, err := EncodeToBytes(&Shirt{ 2, 1, []testColor{ 1, 7 } }, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	// Map mode shows names; unnamed values stay numbers
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, ft, enc)
+	var trim, _ = decMap["Trim"].([]interface{})
+	if err != nil || decMap["Color"] != "blue" || decMap["Size"] != "large" ||
+		len(trim) != 2 || trim[0] != "green" || trim[1] != uint8(7) {
+		test.Errorf("Enum names not rendered: %v %v", err, decMap)
+	}
+
+	// ... and map-mode encoding takes them back
+	enc2, err := EncodeToBytes(&decMap, ft)
+	if err != nil || string(enc2) != string(enc) {
+		test.Errorf("Enum names not encoded: %v %v != %v", err, enc2, enc)
+	}
+
+	decMap["Color"] = "purple"
+	_, err = EncodeToBytes(&decMap, ft)
+	if err == nil {
+		test.Errorf("Unknown enum name encoded")
+	}
+}
+
+type testColorV2 uint8
+
+func (testColorV2) EnumNames() map[int64]string {
+	return map[int64]string{ 0: "red", 2: "green", 3: "blue" }
+}
+
+func TestEnumCompat(test *testing.T) {
+	type v1 struct {
+		_ struct{} `spack:"name=shirt"`
+		Color testColor
+	}
+	type v2 struct {
+		_ struct{} `spack:"name=shirt"`
+		Color testColorV2
+	}
+
+	var diffs = strings.Join(DiffSpecs(MakeTypeSpec(v1{}), MakeTypeSpec(v2{})), "\n")
+	for _, want := range []string{
+		"shirt.Color: enum value green renumbered 1 -> 2",
+		"shirt.Color: enum value blue renumbered 2 -> 3",
+	} {
+		if !strings.Contains(diffs, want) {
+			test.Errorf("Missing diff %q in:\n%s", want, diffs)
+		}
+	}
+
+	type v3 struct {
+		_ struct{} `spack:"name=shirt"`
+		Color uint8
+	}
+	diffs = strings.Join(DiffSpecs(MakeTypeSpec(v1{}), MakeTypeSpec(v3{})), "\n")
+	if !strings.Contains(diffs, "enum value red removed") {
+		test.Errorf("Removed enum values not flagged:\n%s", diffs)
+	}
+}
+
+type testColorV3 uint8
+
+func (testColorV3) EnumNames() map[int64]string {
+	return map[int64]string{ 0: "red", 1: "green", 2: "blue", 3: "purple" }
+}
+
+func TestEnumAddition(test *testing.T) {
+	type v1 struct {
+		_ struct{} `spack:"name=shirt"`
+		Color testColor
+	}
+	type v1Extended struct {
+		_ struct{} `spack:"name=shirt"`
+		Color testColorV3
+	}
+
+	if diffs := DiffSpecs(MakeTypeSpec(v1{}), MakeTypeSpec(v1Extended{})); len(diffs) > 0 {
+		test.Errorf("Added enum value flagged: %v", diffs)
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("shirt")
+	vt.AddVersion(0, v1{}, nil)
+
+	// As if loaded from a stored _type record
+	vt.GetVersion(0).Exemplar = nil
+	vt.Dirty = false
+
+	if err := vt.AddVersion(0, v1Extended{}, nil); err != nil {
+		test.Fatalf("Exemplar with an added enum value rejected: %v", err)
+	}
+	if !vt.Dirty {
+		test.Errorf("Added enum value not marked for storing")
+	}
+
+	var enc, err = vt.EncodeObj(map[string]interface{}{ "Color": "purple" })
+	if err != nil {
+		test.Fatalf("Added enum name not encoded: %v", err)
+	}
+	var dec = make(map[string]interface{})
+	if err = vt.DecodeInto(enc, dec); err != nil || dec["Color"] != "purple" {
+		test.Errorf("Added enum name not decoded: %v %v", err, dec)
+	}
+}
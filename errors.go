@@ -0,0 +1,271 @@
+package spack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// DecodeError reports where decoding failed: the field path (e.g.
+// "User.Addresses[3].Zip"), the byte offset into the encoded value, the
+// kind being decoded there, and the underlying error. Truncated input
+// gives io.ErrUnexpectedEOF.
+type DecodeError struct {
+	Path string
+	Offset int64
+	Kind string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Decoding failed at %s (%s, offset %d): %v", e.Path, e.Kind, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeError reports the field path and kind where encoding failed.
+type EncodeError struct {
+	Path string
+	Kind string
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("Encoding failed at %s (%s): %v", e.Path, e.Kind, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// UpgradeError reports an upgrader failing to take an object from one
+// version to the next.
+type UpgradeError struct {
+	From uint16
+	To uint16
+	Err error
+}
+
+func (e *UpgradeError) Error() string {
+	return fmt.Sprintf("Upgrader error (%d -> %d): %v", e.From, e.To, e.Err)
+}
+
+func (e *UpgradeError) Unwrap() error {
+	return e.Err
+}
+
+// withOffset shifts a DecodeError's offset to count n bytes read
+// before the value, like a record's version header.
+func withOffset(err error, n int64) error {
+	if de, ok := err.(*DecodeError); ok {
+		de.Offset += n
+	}
+	return err
+}
+
+// readError wraps a failed read. Every read is part of a value, so
+// running out of input is always unexpected.
+func readError(what string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("reading %s: %w", what, err)
+}
+
+// -------------------------------
+
+// codecPath follows the codec through a value, one frame per field
+// type entered, so errors can say where they happened. It's only
+// rendered on failure.
+type codecPath struct {
+	frames []pathFrame
+}
+
+type pathFrame struct {
+	ft *fieldType
+	// The slice index or map entry being worked on, or -1
+	index int
+	// The map key whose value is being worked on
+	key reflect.Value
+}
+
+func (p *codecPath) push(ft *fieldType) {
+	p.frames = append(p.frames, pathFrame{ ft, -1, reflect.Value{} })
+}
+
+func (p *codecPath) pop() {
+	p.frames = p.frames[:len(p.frames)-1]
+}
+
+// at records the element a slice or map frame is working on.
+func (p *codecPath) at(index int, key reflect.Value) {
+	var f = &p.frames[len(p.frames)-1]
+	f.index = index
+	f.key = key
+}
+
+// Frames rendered from each end of a long path; the middle is elided
+// so deeply nested failures don't make huge errors.
+const pathEndFrames = 32
+
+func (p *codecPath) String() string {
+	var buf strings.Builder
+	for i, f := range p.frames {
+		if i >= pathEndFrames && i < len(p.frames) - pathEndFrames {
+			if i == pathEndFrames {
+				fmt.Fprintf(&buf, "...(%d more)...", len(p.frames) - 2 * pathEndFrames)
+			}
+			continue
+		}
+
+		var kind = reflect.Kind(f.ft.Kind)
+
+		if i == 0 && kind == STRUCT_REFERENCE {
+			buf.WriteString(shortStructName(f.ft.StructName))
+		}
+		if i > 0 && reflect.Kind(p.frames[i-1].ft.Kind) == STRUCT_REFERENCE {
+			buf.WriteString("." + f.ft.Label)
+		}
+
+		switch {
+		case f.index < 0:
+		case kind == reflect.Slice:
+			fmt.Fprintf(&buf, "[%d]", f.index)
+		case kind == reflect.Map && f.key.IsValid():
+			fmt.Fprintf(&buf, "[%v]", f.key)
+		case kind == reflect.Map:
+			fmt.Fprintf(&buf, "{key %d}", f.index)
+		}
+	}
+
+	if buf.Len() == 0 {
+		return "(top)"
+	}
+	return buf.String()
+}
+
+func (p *codecPath) kind() string {
+	if len(p.frames) == 0 {
+		return "value"
+	}
+	return shapeText(p.frames[len(p.frames)-1].ft)
+}
+
+// -------------------------------
+
+// countingReader is the decoder's input, either buffered from a
+// reader or a byte slice read in place. It tracks the offset into the
+// input, and stops at limit if that's set.
+type countingReader struct {
+	reader *bufio.Reader
+	buf []byte
+	offset int64
+	limit int64
+	// buf as a string, made when strings are first cut from it
+	text string
+}
+
+func (c *countingReader) over(n int64) error {
+	if c.limit > 0 && c.offset + n > c.limit {
+		return &LimitError{ "MaxBytes", uint64(c.offset + n), uint64(c.limit) }
+	}
+	return nil
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	if c.limit > 0 && int64(len(buf)) > c.limit - c.offset {
+		if err := c.over(1); err != nil {
+			return 0, err
+		}
+		buf = buf[:c.limit - c.offset]
+	}
+	var n int
+	var err error
+	if c.reader == nil {
+		n = copy(buf, c.buf[c.offset:])
+		if n == 0 && len(buf) > 0 {
+			err = io.EOF
+		}
+	} else {
+		n, err = c.reader.Read(buf)
+	}
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	if err := c.over(1); err != nil {
+		return 0, err
+	}
+	if c.reader == nil {
+		if c.offset >= int64(len(c.buf)) {
+			return 0, io.EOF
+		}
+		c.offset++
+		return c.buf[c.offset - 1], nil
+	}
+	var b, err = c.reader.ReadByte()
+	if err == nil {
+		c.offset++
+	}
+	return b, err
+}
+
+// next returns the next n bytes. From a slice they're the input
+// itself; otherwise they're only good until the next read. Short
+// input gives what there is and io.EOF.
+func (c *countingReader) next(n uint64) ([]byte, error) {
+	if err := c.over(int64(n)); err != nil {
+		return nil, err
+	}
+
+	if c.reader == nil {
+		var rest = c.buf[c.offset:]
+		if n > uint64(len(rest)) {
+			c.offset += int64(len(rest))
+			return rest, io.EOF
+		}
+		c.offset += int64(n)
+		return rest[:n:n], nil
+	}
+
+	if n <= uint64(c.reader.Size()) {
+		var buf, err = c.reader.Peek(int(n))
+		c.reader.Discard(len(buf))
+		c.offset += int64(len(buf))
+		return buf, err
+	}
+
+	// Grown as it arrives rather than trusting n up front
+	var buf = make([]byte, 0, prealloc(n))
+	for uint64(len(buf)) < n {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		var end = cap(buf)
+		if uint64(end) > n {
+			end = int(n)
+		}
+		var got, err = c.reader.Read(buf[len(buf):end])
+		buf = buf[:len(buf) + got]
+		c.offset += int64(got)
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// substring returns raw, just read from a slice input, as a string
+// sharing one copy of the whole input.
+func (c *countingReader) substring(raw []byte) string {
+	if c.text == "" {
+		c.text = string(c.buf)
+	}
+	var start = c.offset - int64(len(raw))
+	return c.text[start:c.offset]
+}
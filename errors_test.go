@@ -0,0 +1,187 @@
+package spack
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+type errAddress struct {
+	Street string
+	Zip string
+}
+
+type errUser struct {
+	Name string
+	Addresses []errAddress
+	Tags map[string]int32
+}
+
+func TestDecodeErrors(test *testing.T) {
+	var spec = MakeTypeSpec(errUser{})
+
+	var user = errUser{ "ann", []errAddress{ { "a", "1" }, { "b", "22" } }, nil }
+	var enc = mustEncode(test, spec, &user)
+
+	// Name (4) + count (1) + first address (4) + "b" (2) + zip length (1)
+	var cut = enc[:12]
+
+	var dec errUser
+	var err = DecodeFromBytes(&dec, spec, cut)
+
+	var derr *DecodeError
+	if !errors.As(err, &derr) {
+		test.Fatalf("Wrong error type: %T %v", err, err)
+	}
+	if derr.Path != "errUser.Addresses[1].Zip" || derr.Offset != 12 || derr.Kind != "string" {
+		test.Errorf("Wrong error details: %#v", derr)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		test.Errorf("Truncation isn't ErrUnexpectedEOF: %v", err)
+	}
+
+	// Map values are reported by key
+	user = errUser{ "ann", nil, map[string]int32{ "x": 1 } }
+	enc = mustEncode(test, spec, &user)
+
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, spec, enc[:len(enc)-2])
+	if !errors.As(err, &derr) || derr.Path != "errUser.Tags[x]" || derr.Kind != "int32" {
+		test.Errorf("Wrong map error: %v", err)
+	}
+
+	// Offsets from DecodeObj count the version header
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+	vt.AddVersion(0, errUser{}, nil)
+
+	obj, err := vt.EncodeObj(&errUser{ Name: "bob" })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+	_, _, err = vt.DecodeObj(obj[:4], false)
+	if !errors.As(err, &derr) || derr.Path != "errUser.Name" || derr.Offset != 4 {
+		test.Errorf("Wrong DecodeObj error: %v", err)
+	}
+}
+
+func TestEncodeErrors(test *testing.T) {
+	var spec = MakeTypeSpec(errUser{})
+
+	var obj = map[string]interface{}{
+		"Name": "ann",
+		"Addresses": []interface{}{ map[string]interface{}{ "Street": 7 } },
+	}
+	var _, err = EncodeToBytes(obj, spec)
+
+	var eerr *EncodeError
+	if !errors.As(err, &eerr) || eerr.Path != "errUser.Addresses[0].Street" || eerr.Kind != "string" {
+		test.Errorf("Wrong encode error: %v", err)
+	}
+}
+
+func TestCodecErrorsDontPanic(test *testing.T) {
+	var spec = MakeTypeSpec(errUser{})
+
+	var bad = []interface{}{
+		map[string]interface{}{ "Name": []int{ 1 } },
+		map[string]interface{}{ "Addresses": "nope" },
+		map[string]interface{}{ "Addresses": []interface{}{ 7 } },
+		map[string]interface{}{ "Tags": map[string]interface{}{ "x": "y" } },
+		map[string]interface{}{ "Tags": map[string]interface{}{ "x": int64(1) } },
+		map[string]interface{}{ "Name": nil },
+		42,
+		(*errUser)(nil),
+	}
+	for _, obj := range bad {
+		var _, err = EncodeToBytes(obj, spec)
+		var eerr *EncodeError
+		if !errors.As(err, &eerr) {
+			test.Errorf("No EncodeError for %#v: %v", obj, err)
+		}
+	}
+
+	var enc = mustEncode(test, spec, &errUser{ Name: "ann" })
+	var targets = []interface{}{
+		errUser{},
+		&struct{ Name int32 }{},
+		new(string),
+		new(map[string]int32),
+		new([]errUser),
+	}
+	for _, target := range targets {
+		if err := DecodeFromBytes(target, spec, enc); err == nil {
+			test.Errorf("Decoded into %T", target)
+		}
+	}
+}
+
+func TestLookupErrors(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+
+	if _, err := ts.LookupType("nobody"); err == nil {
+		test.Errorf("Missing type found")
+	}
+	if found, err := ts.LookupType("user"); err != nil || found != vt {
+		test.Errorf("Wrong lookup: %v %v", found, err)
+	}
+
+	var tag, key, err = ParseKey(vt.EncodeKey("ann"))
+	if err != nil || tag != vt.Tag || key != "ann" {
+		test.Errorf("Wrong key parse: %d %q %v", tag, key, err)
+	}
+	if _, _, err = ParseKey([]byte{ 1 }); err == nil {
+		test.Errorf("Short key parsed")
+	}
+	if _, err = ts.RegisterType("other").ParseKey(vt.EncodeKey("ann")); err == nil {
+		test.Errorf("Key parsed for the wrong type")
+	}
+
+	if _, _, err = vt.DecodeObj([]byte{ 0 }, false); err == nil {
+		test.Errorf("Short record decoded")
+	}
+}
+
+func TestUpgradeErrors(test *testing.T) {
+	type st0 struct {
+		Name string
+	}
+	type st1 struct {
+		Name string
+		Age uint16
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+	vt.AddVersion(0, st0{}, nil)
+	var enc, err = vt.EncodeObj(&st0{ "ann" })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var refused = errors.New("refused")
+	vt.AddVersion(1, st1{}, func(obj interface{}) (interface{}, error) {
+		return nil, refused
+	})
+
+	_, _, err = vt.DecodeObj(enc, false)
+	var uerr *UpgradeError
+	if !errors.Is(err, refused) || !errors.As(err, &uerr) || uerr.From != 0 || uerr.To != 1 {
+		test.Errorf("Wrong upgrader error: %v", err)
+	}
+
+	// Versions needn't be contiguous
+	vt.AddVersion(5, st1{}, nil)
+	_, _, err = vt.DecodeObj(enc, false)
+	if !errors.As(err, &uerr) || uerr.From != 0 || uerr.To != 1 {
+		test.Errorf("Wrong upgrader error: %v", err)
+	}
+	enc, _ = vt.EncodeObj(&st1{ "ann", 3 })
+	vt.AddVersion(9, st1{}, nil)
+	_, _, err = vt.DecodeObj(enc, false)
+	if err == nil || !strings.Contains(err.Error(), "No upgrader for 5 -> 9") {
+		test.Errorf("Wrong missing upgrader error: %v", err)
+	}
+}
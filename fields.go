@@ -1,12 +1,17 @@
 package spack
 
 import (
-	"bytes"
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 )
 
 const IGNORED_FIELD reflect.Kind = 254
@@ -17,13 +22,45 @@ type fieldType struct {
 	Elem []*fieldType
 	Label string
 	StructName string
+	// Num is a struct field's explicit number from `spack:"n=..."`, or 0
+	Num uint16
+	Flags uint8
+	// Default is the encoded `spack:"default=..."` value, or nil
+	Default []byte
+	// Rules are the field's constraints, e.g. "maxlen=40"
+	Rules []string
+	// Enum holds the symbolic names of integer enum types
+	Enum []EnumValue
+	// Bits is the width of an unsigned int in a packed struct, or 0
+	Bits uint8
 }
 
+// Sparse structs (tagged on a blank field, `spack:"sparse"`) lead with
+// a bitmap of which fields are present and only encode those; other
+// structs get one for any fields tagged `spack:"optional"`. Go fields
+// are present when non-zero, map entries when their key exists.
+const FLAG_SPARSE uint8 = 1
+const FLAG_OPTIONAL uint8 = 2
+
+// Packed structs (`spack:"packed"`, or SpecOptions.PackStructs) store
+// each run of adjacent bools and `spack:"bits=N"` unsigned ints as one
+// bitset, low bits first, padded to a whole byte.
+const FLAG_PACKED uint8 = 4
+
 type structMap map[string]*fieldType
 
 type TypeSpec struct {
 	Structs structMap
 	Top *fieldType
+	// Skipped lists the struct fields left out under FieldPolicySkip or
+	// FieldPolicyWarn, as "struct.Field: reason".
+	Skipped []string
+	// TrackRefs encodes pointers seen before as back-references; see
+	// SpecOptions.TrackRefs.
+	TrackRefs bool
+	// Go structs bound to Structs, a *sync.Map made on first use; see
+	// bindStruct
+	bindings atomic.Value `spack:"ignore"`
 }
 
 
@@ -41,16 +78,111 @@ func (ft *fieldType) String() string {
 	return fmt.Sprintf("{ %v, %#v, %#v, %v }", ft.Kind, ft.Label, ft.StructName, inner)
 }
 
+type SpecOptions struct {
+	// FlattenEmbedded stores the fields of embedded structs as fields of
+	// the parent, following encoding/json's promotion rules, instead of
+	// as a nested struct named after the embedded type.
+	FlattenEmbedded bool
+
+	// PackStructs packs every struct, as if tagged `spack:"packed"`.
+	PackStructs bool
+
+	// Unsupported decides what happens to unexported struct fields and
+	// fields of kinds spack can't store (func, chan, interface, ...).
+	Unsupported FieldPolicy
+
+	// TrackRefs writes each pointer (and map-mode struct) once, encoding
+	// later occurrences by ID, so shared and cyclic graphs round-trip
+	// with identity preserved. Without it, cycles are an error and
+	// shared values are copied.
+	TrackRefs bool
+}
+
+type FieldPolicy uint8
+
+const (
+	// FieldPolicyError refuses to make a spec.
+	FieldPolicyError FieldPolicy = iota
+	// FieldPolicySkip stores the field as ignored. Exported fields,
+	// whose data is lost, are still listed in TypeSpec.Skipped.
+	FieldPolicySkip
+	// FieldPolicyWarn is FieldPolicySkip, listing unexported fields in
+	// TypeSpec.Skipped too.
+	FieldPolicyWarn
+)
+
+// MakeTypeSpec is MakeTypeSpecWithOptions with default options, for
+// types known to be supported; it panics otherwise.
 func MakeTypeSpec(exemplar interface{}) *TypeSpec {
-	var structs = make(structMap)
-	var top = makeFieldType(reflect.TypeOf(exemplar), structs)
+	var spec, err = MakeTypeSpecWithOptions(exemplar, SpecOptions{})
+	if err != nil {
+		panic(err.Error())
+	}
+	return spec
+}
+
+func MakeTypeSpecWithOptions(exemplar interface{}, opts SpecOptions) (*TypeSpec, error) {
+	var typ = reflect.TypeOf(exemplar)
+	if typ == nil {
+		return nil, &TypeError{ "Can't make type spec for nil" }
+	}
+
+	var b = &specBuilder{ make(structMap), opts, nil, nil }
+	var top, err = b.fieldType(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	// Defaults can only be encoded once every struct is known
+	for _, def := range b.defaults {
+		var enc, err = EncodeToBytes(def.value.Interface(), &TypeSpec{ Structs: b.structs, Top: def.ft })
+		if err != nil {
+			return nil, &TypeError{ fmt.Sprintf("Can't encode default for %s: %v", def.ft.Label, err) }
+		}
+		def.ft.Default = enc
+	}
+
 	return &TypeSpec{
-		Structs: structs,
+		Structs: b.structs,
 		Top: top,
+		Skipped: b.skipped,
+		TrackRefs: opts.TrackRefs,
+	}, nil
+}
+
+type specBuilder struct {
+	structs structMap
+	opts SpecOptions
+	skipped []string
+	defaults []pendingDefault
+}
+
+type pendingDefault struct {
+	ft *fieldType
+	value reflect.Value
+}
+
+// skip applies the unsupported field policy, returning false if the
+// field can't be skipped.
+func (b *specBuilder) skip(structName string, field reflect.StructField, reason string) bool {
+	switch b.opts.Unsupported {
+	case FieldPolicySkip:
+		if field.PkgPath == "" {
+			b.skipped = append(b.skipped, fmt.Sprintf("%s.%s: %s", structName, field.Name, reason))
+		}
+		return true
+	case FieldPolicyWarn:
+		b.skipped = append(b.skipped, fmt.Sprintf("%s.%s: %s", structName, field.Name, reason))
+		return true
 	}
+	return false
 }
 
-func makeFieldType(typ reflect.Type, structs structMap) *fieldType {
+func (b *specBuilder) fieldType(typ reflect.Type) (*fieldType, error) {
+
+	if kind, ok := bigKindOf(typ); ok {
+		return &fieldType{ Kind: uint8(kind) }, nil
+	}
 
 	switch typ.Kind() {
 	case reflect.Int8,
@@ -67,83 +199,396 @@ func makeFieldType(typ reflect.Type, structs structMap) *fieldType {
 		reflect.Complex128,
 		reflect.Bool,
 		reflect.String:
-		return &fieldType{ uint8(typ.Kind()), nil, "", "" }
+		return &fieldType{ Kind: uint8(typ.Kind()), Enum: enumValues(typ) }, nil
 
 	case reflect.Slice:
-		var elemType = makeFieldType(typ.Elem(), structs)
-		return &fieldType{ uint8(reflect.Slice), []*fieldType{ elemType }, "", "" }
+		var elemType, err = b.fieldType(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &fieldType{ Kind: uint8(reflect.Slice), Elem: []*fieldType{ elemType } }, nil
 
 	case reflect.Ptr:
-		return &fieldType{ uint8(reflect.Ptr), []*fieldType {
-				makeFieldType(typ.Elem(), structs) }, "", "" }
+		var elemType, err = b.fieldType(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &fieldType{ Kind: uint8(reflect.Ptr), Elem: []*fieldType{ elemType } }, nil
 
 	case reflect.Struct:
 
-		var structName = typ.PkgPath() + "/" + typ.Name()
-		structFt, ok := structs[structName]
-		if !ok {
-			structs[structName] = nil // Avoid reentrance
-			var elems = make([]*fieldType, 0, typ.NumField())
+		var name = structName(typ)
+		if _, ok := b.structs[name]; !ok {
+			b.structs[name] = nil // Avoid reentrance
+
+			var fields []reflect.StructField
+			if b.opts.FlattenEmbedded {
+				fields = flattenFields(typ)
+			} else {
+				fields = directFields(typ)
+			}
+
 			for i := 0; i < typ.NumField(); i++ {
-				var field = typ.Field(i)
+				if field := typ.Field(i); field.Name == "_" {
+					if _, err := readTag(field.Tag); err != nil {
+						delete(b.structs, name)
+						return nil, &TypeError{ fmt.Sprintf("Bad tag on %s: %v", name, err) }
+					}
+				}
+			}
+
+			var packed = b.opts.PackStructs || structTag(typ).has("packed")
 
+			var elems = make([]*fieldType, 0, len(fields))
+			var nums = make(map[uint16]string)
+			var labels = make(map[string]string)
+			for _, field := range fields {
 				var ft *fieldType
+				var tag, err = readTag(field.Tag)
+				if err != nil {
+					delete(b.structs, name)
+					return nil, &TypeError{ fmt.Sprintf("Bad tag on %s.%s: %v", name, field.Name, err) }
+				}
 
-				if field.Tag.Get("spack") == "ignore" {
-					ft = &fieldType{ uint8(IGNORED_FIELD), nil, field.Name, "" }
+				num, err := tag.num()
+				if err == nil && num != 0 && nums[num] != "" {
+					err = fmt.Errorf("also used by %s", nums[num])
+				}
+				if err != nil {
+					delete(b.structs, name)
+					return nil, &TypeError{ fmt.Sprintf("Bad field number on %s.%s: %v", name, field.Name, err) }
+				}
+				if num != 0 {
+					nums[num] = field.Name
+				}
+
+				var label = fieldLabel(field)
+				if labels[label] != "" {
+					delete(b.structs, name)
+					return nil, &TypeError{ fmt.Sprintf("Bad label on %s.%s: %q also used by %s", name, field.Name, label, labels[label]) }
+				}
+				labels[label] = field.Name
+
+				if tag.has("ignore") {
+					ft = &fieldType{ Kind: uint8(IGNORED_FIELD), Label: label }
+				} else if field.PkgPath != "" {
+					if !b.skip(name, field, "unexported") {
+						delete(b.structs, name)
+						return nil, &TypeError{ fmt.Sprintf(
+							"Field %s of %s is unexported (tag it spack:\"ignore\" or use FieldPolicySkip)",
+							field.Name, name) }
+					}
+					ft = &fieldType{ Kind: uint8(IGNORED_FIELD), Label: label }
 				} else {
-					ft = makeFieldType(field.Type, structs)
-					ft.Label = field.Name
+					ft, err = b.fieldType(field.Type)
+					if err != nil {
+						if _, ok := err.(*unsupportedError); !ok || !b.skip(name, field, err.Error()) {
+							delete(b.structs, name)
+							return nil, err
+						}
+						ft = &fieldType{ Kind: uint8(IGNORED_FIELD) }
+					}
+					ft.Label = label
 				}
 
+				ft.Num = num
+				if tag.has("optional") {
+					ft.Flags |= FLAG_OPTIONAL
+				}
+				if reflect.Kind(ft.Kind) != IGNORED_FIELD {
+					ft.Rules, err = tagRules(tag, ft)
+					if err != nil {
+						delete(b.structs, name)
+						return nil, &TypeError{ fmt.Sprintf("Bad constraint on %s.%s: %v", name, field.Name, err) }
+					}
+				}
+				if tag.has("bits") && reflect.Kind(ft.Kind) != IGNORED_FIELD {
+					ft.Bits, err = tagBits(tag["bits"], ft, packed)
+					if err != nil {
+						delete(b.structs, name)
+						return nil, &TypeError{ fmt.Sprintf("Bad bit width on %s.%s: %v", name, field.Name, err) }
+					}
+				}
+				if tag.has("default") && reflect.Kind(ft.Kind) != IGNORED_FIELD {
+					var value, err = defaultValue(tag["default"], field.Type)
+					if err != nil {
+						delete(b.structs, name)
+						return nil, &TypeError{ fmt.Sprintf("Bad default on %s.%s: %v", name, field.Name, err) }
+					}
+					b.defaults = append(b.defaults, pendingDefault{ ft, value })
+				}
 				elems = append(elems, ft)
 			}
-			structFt = &fieldType{ uint8(reflect.Struct), elems, "", "" }
-			structs[structName] = structFt
+
+			// Numbered fields go first, in number order, so their
+			// declaration order doesn't matter
+			sort.SliceStable(elems, func(i, j int) bool {
+				var a, b = elems[i].Num, elems[j].Num
+				return a != 0 && (b == 0 || a < b)
+			})
+
+			var structFt = &fieldType{ Kind: uint8(reflect.Struct), Elem: elems }
+			if structTag(typ).has("sparse") {
+				structFt.Flags |= FLAG_SPARSE
+			}
+			if packed {
+				structFt.Flags |= FLAG_PACKED
+			}
+			b.structs[name] = structFt
 		}
-		
-		return &fieldType{ uint8(STRUCT_REFERENCE), nil, "", structName }
+
+		return &fieldType{ Kind: uint8(STRUCT_REFERENCE), StructName: name }, nil
 
 	case reflect.Map:
-		var keyType = makeFieldType(typ.Key(), structs)
-		var valType = makeFieldType(typ.Elem(), structs)
-		return &fieldType{ uint8(reflect.Map), []*fieldType{ keyType, valType }, "", "" }
+		var keyType, err = b.fieldType(typ.Key())
+		if err != nil {
+			return nil, err
+		}
+		valType, err := b.fieldType(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &fieldType{ Kind: uint8(reflect.Map), Elem: []*fieldType{ keyType, valType } }, nil
 
 	default:
 	}
 
-	panic(fmt.Sprintf("Can't make field type for %v\n", typ.Kind()))
+	return nil, &unsupportedError{ TypeError{ fmt.Sprintf("Can't make field type for %v", typ.Kind()) } }
+}
 
+// unsupportedError marks a kind spack can't store, which the field
+// policy may skip; other spec errors are always fatal.
+type unsupportedError struct {
+	TypeError
 }
 
-func encodeField(field interface{}, ts *TypeSpec, writer *bufio.Writer) {
-	encodeFieldInner(field, ts.Top, ts.Structs, writer)
+// An encoder holds the state of one top-level encode: the output,
+// where it is, for errors, the pointers it's inside, to catch cycles,
+// and under TrackRefs the IDs of those already written. Encoders are
+// pooled, keeping their scratch space between encodes.
+type encoder struct {
+	spec *TypeSpec
+	structs structMap
+	buf []byte
+	path codecPath
+	trackRefs bool
+	active map[refKey]bool
+	refs map[refKey]uint64
+	nextRef uint64
+	// Stacks of struct field values and presence, and of map
+	// iterators, reused as the encoder nests
+	vals []reflect.Value
+	present []bool
+	maps []*mapScratch
+	mapDepth int
+	// Output space for encodes not appending to a caller's buffer
+	own []byte
+	emptyElems uint64
 }
 
-func SafeEncodeField(field interface{}, ts *TypeSpec, writer *bufio.Writer) (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = &TypeError{ 
-				fmt.Sprintf("Encoding failed: %v", e),
-			}
+// mapScratch iterates one map without allocating for each entry.
+type mapScratch struct {
+	iter reflect.MapIter
+	key reflect.Value
+	value reflect.Value
+}
+
+// Pointers to a struct and its first field share an address, so the
+// type is part of the key, and slices of one array differ by length.
+type refKey struct {
+	ptr uintptr
+	typ reflect.Type
+	n int
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &encoder{ active: make(map[refKey]bool) }
+	},
+}
+
+// Larger output space isn't kept in the pool
+const maxPooledBuffer = 64 * 1024
+
+// getEncoder takes a pooled encoder that appends to buf.
+func getEncoder(ts *TypeSpec, buf []byte) *encoder {
+	var e = encoderPool.Get().(*encoder)
+	e.spec = ts
+	e.structs = ts.Structs
+	e.trackRefs = ts.TrackRefs
+	if e.trackRefs && e.refs == nil {
+		e.refs = make(map[refKey]uint64)
+	}
+	e.buf = buf
+	return e
+}
+
+// release drops everything referring to the encoded value and returns
+// e to the pool.
+func (e *encoder) release() {
+	for key := range e.active {
+		delete(e.active, key)
+	}
+	for key := range e.refs {
+		delete(e.refs, key)
+	}
+	e.nextRef = 0
+	e.emptyElems = 0
+
+	var vals = e.vals[:cap(e.vals)]
+	for i := range vals {
+		vals[i] = reflect.Value{}
+	}
+	e.vals = e.vals[:0]
+	e.present = e.present[:0]
+
+	for _, m := range e.maps {
+		m.iter.Reset(reflect.Value{})
+		m.key.Set(reflect.Zero(m.key.Type()))
+		m.value.Set(reflect.Zero(m.value.Type()))
+	}
+	e.mapDepth = 0
+
+	var frames = e.path.frames[:cap(e.path.frames)]
+	for i := range frames {
+		frames[i] = pathFrame{}
+	}
+	e.path.frames = e.path.frames[:0]
+
+	if cap(e.own) > maxPooledBuffer {
+		e.own = nil
+	}
+	e.buf = nil
+	e.spec = nil
+	e.structs = nil
+	encoderPool.Put(e)
+}
+
+// mapScratch starts iterating val, with key and value space of its
+// types.
+func (e *encoder) mapScratch(val reflect.Value) *mapScratch {
+	if e.mapDepth == len(e.maps) {
+		e.maps = append(e.maps, new(mapScratch))
+	}
+	var m = e.maps[e.mapDepth]
+	e.mapDepth++
+
+	var typ = val.Type()
+	if !m.key.IsValid() || m.key.Type() != typ.Key() {
+		m.key = reflect.New(typ.Key()).Elem()
+	}
+	if !m.value.IsValid() || m.value.Type() != typ.Elem() {
+		m.value = reflect.New(typ.Elem()).Elem()
+	}
+	m.iter.Reset(val)
+	return m
+}
+
+// refKeyOf identifies the value behind a pointer, or a map-mode struct.
+// Zero-size values may share addresses and aren't tracked.
+func refKeyOf(val reflect.Value) (refKey, bool) {
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.Type().Elem().Size() == 0 {
+			return refKey{}, false
 		}
-	}()
-	encodeFieldInner(field, ts.Top, ts.Structs, writer)
+	case reflect.Map:
+	default:
+		return refKey{}, false
+	}
+	return refKey{ val.Pointer(), val.Type(), 0 }, true
+}
+
+// containerKey identifies a slice or map whose elements could lead back
+// to it without passing a pointer, e.g. a struct holding the slice it's
+// in.
+func containerKey(val reflect.Value, elems ...*fieldType) (refKey, bool) {
+	if val.Len() == 0 {
+		return refKey{}, false
+	}
+	for _, elem := range elems {
+		switch reflect.Kind(elem.Kind) {
+		case reflect.Slice, reflect.Map, reflect.Ptr, STRUCT_REFERENCE:
+			return refKey{ val.Pointer(), val.Type(), val.Len() }, true
+		}
+	}
+	return refKey{}, false
+}
+
+// enter marks a container as being encoded, failing if it already is.
+func (e *encoder) enter(key refKey) error {
+	if e.active[key] {
+		return &TypeError{ fmt.Sprintf("Cycle detected at %v", key.typ) }
+	}
+	e.active[key] = true
 	return nil
 }
 
+func encodeField(field interface{}, ts *TypeSpec, writer *bufio.Writer) error {
+	return SafeEncodeField(field, ts, writer)
+}
+
+// SafeEncodeField encodes field as ts describes. Failures are returned
+// as *EncodeError, with nothing written; the codec doesn't panic on bad
+// input.
+func SafeEncodeField(field interface{}, ts *TypeSpec, writer *bufio.Writer) error {
+	var e = getEncoder(ts, nil)
+	e.buf = e.own[:0]
+	var err = e.run(field, ts)
+	if err == nil {
+		_, err = writer.Write(e.buf)
+	}
+	e.own = e.buf[:0]
+	e.release()
+	return err
+}
+
 func EncodeToBytes(field interface{}, ts *TypeSpec) ([]byte, error) {
-	var buf bytes.Buffer
-	var writer = bufio.NewWriter(&buf)
-	var err = SafeEncodeField(field, ts, writer)
+	return AppendEncode(nil, field, ts)
+}
+
+// AppendEncode appends field's encoding to dst and returns the
+// extended buffer; on failure, dst is returned as it was. Go values
+// encode without allocating when dst has room, though big numbers,
+// enum names and defaults may.
+func AppendEncode(dst []byte, field interface{}, ts *TypeSpec) ([]byte, error) {
+	var e = getEncoder(ts, dst)
+	var err = e.run(field, ts)
+	var out = e.buf
+	e.release()
 	if err != nil {
-		return nil, err
+		return dst, err
 	}
-	writer.Flush()
-	return buf.Bytes(), nil
+	return out, nil
 }
 
-func encodeFieldInner(field interface{}, ft *fieldType, structs structMap, writer *bufio.Writer) {
+func (e *encoder) run(field interface{}, ts *TypeSpec) error {
+	if err := e.encode(reflect.ValueOf(field), ts.Top); err != nil {
+		return &EncodeError{ e.path.String(), e.path.kind(), err }
+	}
+	return nil
+}
+
+// encode writes one value. On failure the path is left where it
+// happened, for the error.
+func (e *encoder) encode(val reflect.Value, ft *fieldType) error {
+	e.path.push(ft)
+	if len(e.path.frames) > DEFAULT_MAX_DEPTH {
+		return &LimitError{ "MaxDepth", uint64(len(e.path.frames)), DEFAULT_MAX_DEPTH }
+	}
+	if err := e.encodeValue(val, ft); err != nil {
+		return err
+	}
+	e.path.pop()
+	return nil
+}
+
+func (e *encoder) encodeValue(val reflect.Value, ft *fieldType) error {
+
+	// Map-mode values come boxed
+	for val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
 
 	switch reflect.Kind(ft.Kind) {
 	case reflect.Int8,
@@ -158,85 +603,189 @@ func encodeFieldInner(field interface{}, ft *fieldType, structs structMap, write
 		reflect.Float64,
 		reflect.Complex64,
 		reflect.Complex128: 
-		encodeFixedSize(field, ft.Kind, writer)
+		val, err := enumFromName(val, ft)
+		if err != nil {
+			return err
+		}
+		e.buf, err = appendFixedSize(e.buf, val, reflect.Kind(ft.Kind))
+		return err
 
 	case reflect.Bool:
-		var n int
-		var err error
-		if field.(bool) {
-			n, err = writer.Write([]byte{ 1 })
-		} else {
-			n, err = writer.Write([]byte{ 0 })
+		if val.Kind() != reflect.Bool {
+			return wrongValue(val, ft)
 		}
-
-		if n != 1 || err != nil {
-			panic(fmt.Sprintf("Bool encode error: %v\n", err))
+		var b byte
+		if val.Bool() {
+			b = 1
 		}
+		e.buf = append(e.buf, b)
 		
 	case reflect.String:
-		var str = field.(string)
-		writeLength(len(str), writer)
-		_, err := writer.WriteString(str)
-		if err != nil {
-			panic(fmt.Sprintf("String length encode error: %v\n", err))
+		if val.Kind() != reflect.String {
+			return wrongValue(val, ft)
 		}
+		var str = val.String()
+		e.buf = appendLength(e.buf, len(str))
+		e.buf = append(e.buf, str...)
 
 	case reflect.Slice:
-		var val = reflect.ValueOf(field)
+		if val.Kind() != reflect.Slice {
+			return wrongValue(val, ft)
+		}
 		var sliceLen = val.Len()
-		writeLength(sliceLen, writer)
+		e.buf = appendLength(e.buf, sliceLen)
+		if elemKind := reflect.Kind(ft.Elem[0].Kind); bulkKind(elemKind) && val.Type().Elem().Kind() == elemKind {
+			e.buf = appendNumbers(e.buf, val, elemKind)
+			return nil
+		}
+		var key, tracked = containerKey(val, ft.Elem[0])
+		if tracked {
+			if err := e.enter(key); err != nil {
+				return err
+			}
+		}
 		for i := 0; i < sliceLen; i++ {
-			encodeFieldInner(val.Index(i).Interface(), ft.Elem[0], structs, writer)
+			e.path.at(i, reflect.Value{})
+			var start = len(e.buf)
+			if err := e.encode(val.Index(i), ft.Elem[0]); err != nil {
+				return err
+			}
+			if err := e.emptyElem(start); err != nil {
+				return err
+			}
+		}
+		if tracked {
+			delete(e.active, key)
 		}
 
 	case reflect.Map:
-		var val = reflect.ValueOf(field)
-		var keyCount = val.Len()
-		writeLength(keyCount, writer)
-		var keys = val.MapKeys()
-		for _, key := range keys {
-			encodeFieldInner(key.Interface(), ft.Elem[0], structs, writer)
-			var value = val.MapIndex(key)
-			encodeFieldInner(value.Interface(), ft.Elem[1], structs, writer)
+		if val.Kind() != reflect.Map {
+			return wrongValue(val, ft)
+		}
+		var key, tracked = containerKey(val, ft.Elem[0], ft.Elem[1])
+		if tracked {
+			if err := e.enter(key); err != nil {
+				return err
+			}
+		}
+		e.buf = appendLength(e.buf, val.Len())
+		var m = e.mapScratch(val)
+		for i := 0; m.iter.Next(); i++ {
+			m.key.SetIterKey(&m.iter)
+			m.value.SetIterValue(&m.iter)
+			e.path.at(i, reflect.Value{})
+			var start = len(e.buf)
+			if err := e.encode(m.key, ft.Elem[0]); err != nil {
+				return err
+			}
+			e.path.at(i, m.key)
+			if err := e.encode(m.value, ft.Elem[1]); err != nil {
+				return err
+			}
+			if err := e.emptyElem(start); err != nil {
+				return err
+			}
+		}
+		e.mapDepth--
+		if tracked {
+			delete(e.active, key)
 		}
 
 	case reflect.Ptr:
+		// Map-mode values may be the element itself
+		var nilable = val.Kind() == reflect.Ptr || val.Kind() == reflect.Map || val.Kind() == reflect.Slice
 
-		var valType = reflect.TypeOf(field)
-		var val = reflect.ValueOf(field)
+		if !val.IsValid() || (nilable && val.IsNil()) {
+			e.buf = append(e.buf, 0)
+			return nil
+		}
 
-		if valType == nil || val.IsNil() {
-			writer.Write([]byte{ 0 })
-		} else {
-			writer.Write([]byte{ 1 })
-			if valType.Kind() == reflect.Ptr {
-				val = val.Elem()
+		var key, tracked = refKeyOf(val)
+		if id, seen := e.refs[key]; tracked && seen {
+			e.buf = append(e.buf, 2)
+			e.buf = binary.AppendUvarint(e.buf, id)
+			return nil
+		}
+		if tracked && e.active[key] {
+			return &TypeError{ fmt.Sprintf("Cycle detected at %v (set TrackRefs to encode it)", val.Type()) }
+		}
+
+		e.buf = append(e.buf, 1)
+		if e.trackRefs {
+			// Every written pointer takes an ID, as the decoder can't
+			// tell which were tracked
+			if tracked {
+				e.refs[key] = e.nextRef
 			}
-			encodeFieldInner(val.Interface(), ft.Elem[0], structs, writer)
+			e.nextRef++
 		}
 
+		if tracked {
+			e.active[key] = true
+		}
+		if val.Kind() == reflect.Ptr {
+			val = val.Elem()
+		}
+		if err := e.encode(val, ft.Elem[0]); err != nil {
+			return err
+		}
+		if tracked {
+			delete(e.active, key)
+		}
+
+	case BIG_INT, BIG_FLOAT, BIG_RAT:
+		return e.encodeBig(val, reflect.Kind(ft.Kind))
+
 	case IGNORED_FIELD:
-		return
+		return nil
 
 	case STRUCT_REFERENCE:
-		var val = reflect.Indirect(reflect.ValueOf(field))
+		val = reflect.Indirect(val)
 
-		var structFt = structs[ft.StructName]
+		var structFt = e.structs[ft.StructName]
+		if structFt == nil {
+			return &TypeError{ fmt.Sprintf("No such struct in spec: %s", ft.StructName) }
+		}
 
-		if val.Type().Kind() == reflect.Map {
-			var mapVal = val.Interface().(map[string]interface{})
-			for _, fieldFt := range structFt.Elem {
+		// Taken from the encoder's stacks, and given back once the
+		// fields are written
+		var mark = len(e.vals)
+		e.vals = append(e.vals, make([]reflect.Value, len(structFt.Elem))...)
+		e.present = append(e.present, make([]bool, len(structFt.Elem))...)
+		var vals = e.vals[mark:]
+		var present = e.present[mark:]
+
+		switch val.Kind() {
+		case reflect.Map:
+			var mapVal, ok = val.Interface().(map[string]interface{})
+			if !ok {
+				return wrongValue(val, ft)
+			}
+			for i, fieldFt := range structFt.Elem {
 				if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
 					continue
 				}
-				var fieldVal = mapVal[fieldFt.Label]
-				encodeFieldInner(fieldVal, fieldFt, structs, writer)
+				var fieldVal, ok = mapVal[fieldFt.Label]
+				present[i] = ok || !hasSlot(structFt, fieldFt)
+				if ok {
+					vals[i] = reflect.ValueOf(fieldVal)
+				} else if present[i] {
+					var def, err = defaultMapValue(fieldFt, e.structs)
+					if err != nil {
+						return fmt.Errorf("bad default for %s: %w", fieldFt.Label, err)
+					}
+					vals[i] = reflect.ValueOf(def)
+				}
 			}
-		} else {
 
-			var valName = val.Type().PkgPath() + "/" + val.Type().Name()
-			if valName != ft.StructName {
-				panic(fmt.Sprintf("Incompatible structs: %s, %s", valName, ft.StructName))
+		case reflect.Struct:
+			binding, err := bindStruct(val.Type(), ft.StructName, e.spec)
+			if err != nil {
+				return err
+			}
+			if len(binding.unbound) > 0 {
+				return &TypeError{ fmt.Sprintf("Struct %s has fields not in the spec: %s",
+					structName(val.Type()), strings.Join(binding.unbound, ", ")) }
 			}
 
 			for i, fieldFt := range structFt.Elem {
@@ -245,48 +794,227 @@ func encodeFieldInner(field interface{}, ft *fieldType, structs structMap, write
 				if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
 					continue
 				}
-				encodeFieldInner(val.Field(i).Interface(), fieldFt, structs, writer)
+				var index = binding.fields[i]
+				if index == nil {
+					if hasSlot(structFt, fieldFt) {
+						continue
+					}
+					if fieldFt.Default != nil {
+						var def, err = defaultMapValue(fieldFt, e.structs)
+						if err != nil {
+							return fmt.Errorf("bad default for %s: %w", fieldFt.Label, err)
+						}
+						present[i] = true
+						vals[i] = reflect.ValueOf(def)
+						continue
+					}
+					return &TypeError{ fmt.Sprintf("Struct %s has no field %s", structName(val.Type()), fieldFt.Label) }
+				}
+				var fieldVal = fieldForRead(val, index)
+				present[i] = !hasSlot(structFt, fieldFt) || !fieldVal.IsZero()
+				vals[i] = fieldVal
 			}
+
+		default:
+			return wrongValue(val, ft)
 		}
 
+		e.buf = appendPresence(e.buf, structFt, present)
+		if err := e.structFields(structFt, vals, present); err != nil {
+			return err
+		}
+		e.vals = e.vals[:mark]
+		e.present = e.present[:mark]
+
 	default:
-		panic(fmt.Sprintf("Unsupported encode kind %v\n", ft.Kind))
+		return &TypeError{ fmt.Sprintf("Unsupported encode kind %v", ft.Kind) }
 	}
+
+	return nil
+}
+
+// wrongValue reports a value that doesn't fit the spec, as from
+// mismatched map-mode data.
+func wrongValue(val reflect.Value, ft *fieldType) error {
+	return &TypeError{ fmt.Sprintf("Can't encode %s as %s", valueType(val), shapeText(ft)) }
 }
 
-func writeLength(length int, writer *bufio.Writer) {
+// valueType names val's type as %T would.
+func valueType(val reflect.Value) string {
+	if !val.IsValid() {
+		return "<nil>"
+	}
+	return val.Type().String()
+}
+
+// hasSlot reports whether a struct field has a bit in the presence
+// bitmap, rather than always being present.
+func hasSlot(structFt *fieldType, fieldFt *fieldType) bool {
+	return reflect.Kind(fieldFt.Kind) != IGNORED_FIELD &&
+		(structFt.Flags & FLAG_SPARSE != 0 || fieldFt.Flags & FLAG_OPTIONAL != 0)
+}
+
+// presenceSlots gives each field of a struct its bit in the presence
+// bitmap, or -1 if it's always present, and the number of bits.
+func presenceSlots(structFt *fieldType) ([]int, int) {
+	var slots = make([]int, len(structFt.Elem))
+	var count = 0
+	for i, fieldFt := range structFt.Elem {
+		slots[i] = -1
+		if hasSlot(structFt, fieldFt) {
+			slots[i] = count
+			count++
+		}
+	}
+	return slots, count
+}
+
+// appendPresence appends the presence bitmap of a struct's fields, as
+// presenceSlots numbers them.
+func appendPresence(buf []byte, structFt *fieldType, present []bool) []byte {
+	var start = len(buf)
+	var slot = 0
+	for i, fieldFt := range structFt.Elem {
+		if !hasSlot(structFt, fieldFt) {
+			continue
+		}
+		if slot % 8 == 0 {
+			buf = append(buf, 0)
+		}
+		if present[i] {
+			buf[start + slot / 8] |= 1 << uint(slot % 8)
+		}
+		slot++
+	}
+	return buf
+}
+
+func readPresence(slots []int, tracked int, reader io.Reader) ([]bool, error) {
+	var present = make([]bool, len(slots))
+	var bitmap = make([]byte, (tracked + 7) / 8)
+	if _, err := io.ReadFull(reader, bitmap); err != nil {
+		return nil, readError("presence bitmap", err)
+	}
+	for i, slot := range slots {
+		present[i] = slot < 0 || bitmap[slot / 8] & (1 << uint(slot % 8)) != 0
+	}
+	return present, nil
+}
+
+func appendLength(buf []byte, length int) []byte {
+	return binary.AppendUvarint(buf, uint64(length))
+}
+
+func writeLength(length int, writer *bufio.Writer) error {
 	var buf = make([]byte, binary.MaxVarintLen64)
 	var lenLen = binary.PutUvarint(buf, uint64(length))
 	_, err := writer.Write(buf[:lenLen])
+	return err
+}
+
+
+// A decoder holds the state of one top-level decode: where it is, for
+// errors, and under TrackRefs the pointers decoded so far, indexed by
+// ID.
+type decoder struct {
+	spec *TypeSpec
+	structs structMap
+	reader *countingReader
+	path codecPath
+	trackRefs bool
+	refs []reflect.Value
+	limits DecodeOptions
+	allocated uint64
+	emptyElems uint64
+}
+
+var byteType = reflect.TypeOf(byte(0))
+
+// newDecoder reads from reader, or from buf in place if reader is nil.
+func newDecoder(ts *TypeSpec, reader *bufio.Reader, buf []byte, opts DecodeOptions) *decoder {
+	return &decoder{
+		spec: ts,
+		structs: ts.Structs,
+		reader: &countingReader{ reader: reader, buf: buf, limit: opts.MaxBytes },
+		trackRefs: ts.TrackRefs,
+		limits: opts,
+	}
+}
+
+func (d *decoder) track(ptr reflect.Value) {
+	if d.trackRefs {
+		d.refs = append(d.refs, ptr)
+	}
+}
+
+func (d *decoder) ref() (reflect.Value, error) {
+	var id, err = binary.ReadUvarint(d.reader)
 	if err != nil {
-		panic(fmt.Sprintf("String length encode error: %v\n", err))
+		return reflect.Value{}, readError("reference ID", err)
+	}
+	if id >= uint64(len(d.refs)) {
+		return reflect.Value{}, &TypeError{ fmt.Sprintf("Reference to unknown ID %d", id) }
 	}
+	return d.refs[id], nil
 }
 
+func decodeField(field interface{}, ts *TypeSpec, reader *bufio.Reader) error {
+	return SafeDecodeField(field, ts, reader)
+}
 
-func decodeField(field interface{}, ts *TypeSpec, reader *bufio.Reader) {
-	decodeFieldInner(field, ts.Top, ts.Structs, reader)
+// SafeDecodeField decodes into field, which must be a non-nil pointer
+// (or, for structs in map mode, map). Failures are returned as
+// *DecodeError; the codec doesn't panic on bad input.
+func SafeDecodeField(field interface{}, ts *TypeSpec, reader *bufio.Reader) error {
+	return SafeDecodeFieldWithOptions(field, ts, reader, DecodeOptions{})
 }
 
-func SafeDecodeField(field interface{}, ts *TypeSpec, reader *bufio.Reader) (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = &TypeError{ 
-				fmt.Sprintf("Decoding failed: %v", e),
-			}
-		}
-	}()
-	decodeFieldInner(field, ts.Top, ts.Structs, reader)
+// SafeDecodeFieldWithOptions is SafeDecodeField within the limits in
+// opts. Going over one fails with a *LimitError inside the
+// *DecodeError.
+func SafeDecodeFieldWithOptions(field interface{}, ts *TypeSpec, reader *bufio.Reader, opts DecodeOptions) error {
+	return decodeTop(field, ts, newDecoder(ts, reader, nil, opts))
+}
+
+func decodeTop(field interface{}, ts *TypeSpec, d *decoder) error {
+	var val = reflect.ValueOf(field)
+	if val.Kind() == reflect.Map && reflect.Kind(ts.Top.Kind) != STRUCT_REFERENCE {
+		return wrongTarget(field, ts.Top)
+	}
+	if (val.Kind() != reflect.Ptr && val.Kind() != reflect.Map) || val.IsNil() {
+		return &TypeError{ fmt.Sprintf("Can't decode into %T: not a non-nil pointer", field) }
+	}
+	if err := d.decode(field, ts.Top); err != nil {
+		return &DecodeError{ d.path.String(), d.reader.offset, d.path.kind(), err }
+	}
 	return nil
 }
 
 func DecodeFromBytes(field interface{}, ts *TypeSpec, enc []byte) (err error) {
-	var buf = bytes.NewBuffer(enc)
-	var reader = bufio.NewReader(buf)
-	return SafeDecodeField(field, ts, reader)
+	return DecodeFromBytesWithOptions(field, ts, enc, DecodeOptions{})
+}
+
+// DecodeFromBytesWithOptions is SafeDecodeFieldWithOptions reading enc
+// in place, so it can alias it under AliasBytes and AliasStrings.
+func DecodeFromBytesWithOptions(field interface{}, ts *TypeSpec, enc []byte, opts DecodeOptions) error {
+	return decodeTop(field, ts, newDecoder(ts, nil, enc, opts))
+}
+
+// decode reads one value into field, a pointer. On failure the path is
+// left where it happened, for the error.
+func (d *decoder) decode(field interface{}, ft *fieldType) error {
+	d.path.push(ft)
+	if len(d.path.frames) > d.maxDepth() {
+		return &LimitError{ "MaxDepth", uint64(len(d.path.frames)), uint64(d.maxDepth()) }
+	}
+	if err := d.decodeValue(field, ft); err != nil {
+		return err
+	}
+	d.path.pop()
+	return nil
 }
 
-func decodeFieldInner(field interface{}, ft *fieldType, structs structMap, reader *bufio.Reader) {
+func (d *decoder) decodeValue(field interface{}, ft *fieldType) error {
 
 	switch reflect.Kind(ft.Kind) {
 	case reflect.Int8,
@@ -301,84 +1029,130 @@ func decodeFieldInner(field interface{}, ft *fieldType, structs structMap, reade
 		reflect.Float64,
 		reflect.Complex64,
 		reflect.Complex128:
-		var err = binary.Read(reader, binary.BigEndian, field)
+		if reflect.TypeOf(field).Elem().Kind() != reflect.Kind(ft.Kind) {
+			return wrongTarget(field, ft)
+		}
+		var err = binary.Read(d.reader, binary.BigEndian, field)
 		if err != nil {
-			panic(fmt.Sprintf("Fixed size decode error: %v\n", err))
+			return readError("fixed-size value", err)
 		}
 
 	case reflect.Bool:
-		var byte = make([]byte, 1)
-		n, err := reader.Read(byte)
-		if n != 1 || err != nil {
-			panic(fmt.Sprintf("Bool decode error: %v\n", err))
+		var target = reflect.ValueOf(field).Elem()
+		if target.Kind() != reflect.Bool {
+			return wrongTarget(field, ft)
 		}
 
-		if byte[0] == 0 {
-			*field.(*bool) = false
-		} else if byte[0] == 1 {
-			*field.(*bool) = true
+		byte, err := d.reader.ReadByte()
+		if err != nil {
+			return readError("bool", err)
+		}
+
+		if byte == 0 {
+			target.SetBool(false)
+		} else if byte == 1 {
+			target.SetBool(true)
 		} else {
-			panic(fmt.Sprintf("Bool byte neither 0 nor 1: %v", byte[0]))
+			return &TypeError{ fmt.Sprintf("Bool byte neither 0 nor 1: %v", byte) }
 		}
 
 	case reflect.String:
-		byteLen, err := binary.ReadUvarint(reader)
+		var target = reflect.ValueOf(field).Elem()
+		if target.Kind() != reflect.String {
+			return wrongTarget(field, ft)
+		}
+
+		byteLen, err := binary.ReadUvarint(d.reader)
 		if err != nil {
-			panic(fmt.Sprintf("Couldn't read string length: %v\n", err))
+			return readError("string length", err)
 		}
 
-		var runes = make([]rune, 0, byteLen)
-		var byteCount uint64 = 0
+		if err := checkLen("MaxStringLen", byteLen, d.limits.MaxStringLen); err != nil {
+			return err
+		}
+		if err := d.allocBytes(byteLen, 1); err != nil {
+			return err
+		}
 
-		for byteCount < byteLen {
-			rune, n, err := reader.ReadRune()
-			if err != nil {
-				panic(fmt.Sprintf("Rune read error: %v\n", err))
-			}
-			runes = append(runes, rune)
-			byteCount += uint64(n)
+		raw, err := d.reader.next(byteLen)
+		if err != nil {
+			return readError("string", err)
 		}
 
-		*field.(*string) = string(runes)
+		switch {
+		case d.limits.UTF8 != UTF8Allow && !utf8.Valid(raw):
+			if d.limits.UTF8 == UTF8Strict {
+				return &TypeError{ fmt.Sprintf("Invalid UTF-8 in string: %q", raw) }
+			}
+			// Each bad byte becomes U+FFFD
+			target.SetString(string([]rune(string(raw))))
+		case d.limits.AliasStrings && d.reader.reader == nil:
+			target.SetString(d.reader.substring(raw))
+		default:
+			target.SetString(string(raw))
+		}
 
 	case reflect.Slice:
+		resultv := reflect.ValueOf(field)
+		slicev := resultv.Elem()
+		if slicev.Kind() != reflect.Slice {
+			return wrongTarget(field, ft)
+		}
 
-		elemCount64, err := binary.ReadUvarint(reader)
+		elemCount64, err := binary.ReadUvarint(d.reader)
 		if err != nil {
-			panic(fmt.Sprintf("Couldn't read slice length: %v\n", err))
+			return readError("slice length", err)
+		}
+		if err := checkLen("MaxSliceLen", elemCount64, d.limits.MaxSliceLen); err != nil {
+			return err
 		}
 		var elemCount = int(elemCount64)
 
-		resultv := reflect.ValueOf(field)
-		slicev := resultv.Elem()
 		elemt := slicev.Type().Elem()
 
-		for i := 0; i < elemCount; i++ {
-			slicev = slicev.Slice(0, i)
-
-			var elemp reflect.Value
-			if elemt.Kind() == reflect.Interface {
-				elemp = reflect.ValueOf(createMapValue(ft.Elem[0]))
-			} else {
-				elemp = reflect.New(elemt)
-			}
+		if elemKind := reflect.Kind(ft.Elem[0].Kind); bulkKind(elemKind) && elemt.Kind() == elemKind {
+			return d.decodeNumbers(slicev, elemCount64, elemKind)
+		}
 
+		if err := d.alloc(elemCount64, elemt); err != nil {
+			return err
+		}
 
-			decodeFieldInner(elemp.Interface(), ft.Elem[0], structs, reader)
-			slicev = reflect.Append(slicev, elemp.Elem())
+		for i := 0; i < elemCount; i++ {
+			d.path.at(i, reflect.Value{})
+			var start = d.reader.offset
+			var elem, err = d.elem(elemt, ft.Elem[0])
+			if err != nil {
+				return err
+			}
+			if err := d.emptyElem(start); err != nil {
+				return err
+			}
+			slicev = slicev.Slice(0, i)
+			slicev = reflect.Append(slicev, elem)
 		}
 
 		resultv.Elem().Set(slicev.Slice(0, elemCount))
 
 	case reflect.Map:
+		var resultv = reflect.ValueOf(field).Elem()
+		if resultv.Kind() != reflect.Map {
+			return wrongTarget(field, ft)
+		}
 
-		keyCount64, err := binary.ReadUvarint(reader)
+		keyCount64, err := binary.ReadUvarint(d.reader)
 		if err != nil {
-			panic(fmt.Sprintf("Couldn't read key count: %v\n", err))
+			return readError("key count", err)
+		}
+		if err := checkLen("MaxMapLen", keyCount64, d.limits.MaxMapLen); err != nil {
+			return err
+		}
+		var entry = resultv.Type().Key().Size() + resultv.Type().Elem().Size()
+		if err := d.allocBytes(keyCount64, uint64(entry) + 1); err != nil {
+			return err
 		}
 
 		var keyCount = int(keyCount64)
-		var resultv = reflect.ValueOf(field).Elem()
 
 		if resultv.IsNil() {
 			resultv.Set(reflect.MakeMap(resultv.Type()))
@@ -388,125 +1162,438 @@ func decodeFieldInner(field interface{}, ft *fieldType, structs structMap, reade
 		var valt = resultv.Type().Elem()
 
 		for i := 0; i < keyCount; i++ {
-			var keyp = reflect.New(keyt)
-			decodeFieldInner(keyp.Interface(), ft.Elem[0], structs, reader)
-			var valp = reflect.New(valt)
-			decodeFieldInner(valp.Interface(), ft.Elem[1], structs, reader)
-			resultv.SetMapIndex(keyp.Elem(), valp.Elem())
+			d.path.at(i, reflect.Value{})
+			var start = d.reader.offset
+			var key, err = d.elem(keyt, ft.Elem[0])
+			if err != nil {
+				return err
+			}
+			if !key.Type().Comparable() {
+				return &TypeError{ fmt.Sprintf("Map key %v can't be used in map mode", key.Type()) }
+			}
+			d.path.at(i, key)
+			val, err := d.elem(valt, ft.Elem[1])
+			if err != nil {
+				return err
+			}
+			if err := d.emptyElem(start); err != nil {
+				return err
+			}
+			resultv.SetMapIndex(key, val)
 		}
 
 
 	case reflect.Ptr:
-		c, err := reader.ReadByte()
+		c, err := d.reader.ReadByte()
 		if err != nil {
-			panic(fmt.Sprintf("Couldn't read ptr nil byte: %v\n", err))
+			return readError("pointer flag", err)
 		}
 
-		if c != 0 {
-			var val = reflect.ValueOf(field)
-			var target = reflect.Indirect(val)
+		if c == 0 {
+			return nil
+		}
+
+		var val = reflect.ValueOf(field)
+		var target = reflect.Indirect(val)
 
-			if target.IsNil() {
-				target.Set(reflect.New(target.Type().Elem()))
+		if c == 2 {
+			if !d.trackRefs {
+				return &TypeError{ "Back-reference in spec without TrackRefs" }
+			}
+			var ref, err = d.ref()
+			if err != nil {
+				return err
+			}
+			// Map-mode targets point straight at the element
+			if target.Kind() != reflect.Ptr {
+				target, ref = val.Elem(), ref.Elem()
 			}
+			if !ref.Type().AssignableTo(target.Type()) {
+				return &TypeError{ fmt.Sprintf("Back-reference to %v can't be stored in %v", ref.Type(), target.Type()) }
+			}
+			target.Set(ref)
+			return nil
+		}
+
+		if target.Kind() != reflect.Ptr {
+			d.track(val)
+			return d.decode(field, ft.Elem[0])
+		}
 
-			decodeFieldInner(target.Interface(), ft.Elem[0], structs, reader)
+		if target.IsNil() {
+			if err := d.alloc(1, target.Type().Elem()); err != nil {
+				return err
+			}
+			target.Set(reflect.New(target.Type().Elem()))
 		}
 
+		// Registered before decoding, for cycles
+		d.track(reflect.ValueOf(target.Interface()))
+		return d.decode(target.Interface(), ft.Elem[0])
+
+	case BIG_INT, BIG_FLOAT, BIG_RAT:
+		return d.decodeBig(field, reflect.Kind(ft.Kind))
+
 	case IGNORED_FIELD:
-		return
+		return nil
 
 	case STRUCT_REFERENCE:
 		
 		var val = reflect.ValueOf(field)
 		val = reflect.Indirect(val)
 
-		var structFt = structs[ft.StructName]
+		var structFt = d.structs[ft.StructName]
+		if structFt == nil {
+			return &TypeError{ fmt.Sprintf("No such struct in spec: %s", ft.StructName) }
+		}
 
-		if val.Type().Kind() == reflect.Map {
-			for _, fieldFt := range structFt.Elem {
-				if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+		var slots, tracked = presenceSlots(structFt)
+		var present, err = readPresence(slots, tracked, d.reader)
+		if err != nil {
+			return err
+		}
+
+		var targets = make([]interface{}, len(structFt.Elem))
+
+		switch val.Kind() {
+		case reflect.Map:
+			if _, ok := val.Interface().(map[string]interface{}); !ok {
+				return wrongTarget(field, ft)
+			}
+
+			for i, fieldFt := range structFt.Elem {
+				// Absent fields are left out, so callers can tell them
+				// from zero values
+				if reflect.Kind(fieldFt.Kind) != IGNORED_FIELD && present[i] {
+					targets[i] = createMapValue(fieldFt)
+				}
+			}
+
+			if err := d.structFields(structFt, targets, present); err != nil {
+				return err
+			}
+
+			for i, fieldFt := range structFt.Elem {
+				if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD || !present[i] {
 					continue
 				}
 				var key = fieldFt.Label
-				var fieldVal = createMapValue(fieldFt)
-				decodeFieldInner(fieldVal, fieldFt, structs, reader)
-				if fieldVal == nil {
+				if targets[i] == nil {
 					val.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(nil))
 				} else {
-					val.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(fieldVal).Elem())
+					val.SetMapIndex(reflect.ValueOf(key), enumMapValue(reflect.ValueOf(targets[i]).Elem(), fieldFt))
 				}
 			}
-		} else {
 
-			var valName = val.Type().PkgPath() + "/" + val.Type().Name()
-			if valName != ft.StructName {
-				panic(fmt.Sprintf("Incompatible structs: %s, %s", valName, ft.StructName))
+		case reflect.Struct:
+			binding, err := bindStruct(val.Type(), ft.StructName, d.spec)
+			if err != nil {
+				return err
 			}
 
 			for i, fieldFt := range structFt.Elem {
 				if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
 					continue
 				}
-				var fieldVal = val.Field(i).Addr()
-				decodeFieldInner(fieldVal.Interface(), fieldFt, structs, reader)
+				var index = binding.fields[i]
+				switch {
+				case !present[i]:
+					if index != nil {
+						var target = fieldForWrite(val, index)
+						target.Set(reflect.Zero(target.Type()))
+					}
+				case index == nil:
+					// Stored field the Go struct no longer has
+					targets[i] = createMapValue(fieldFt)
+				default:
+					targets[i] = fieldForWrite(val, index).Addr().Interface()
+				}
+			}
+
+			if err := d.structFields(structFt, targets, present); err != nil {
+				return err
 			}
+
+			for _, def := range binding.defaults {
+				var target = fieldForWrite(val, def.index).Addr().Interface()
+				var err = newDecoder(def.spec, nil, def.enc, DecodeOptions{}).decode(target, def.spec.Top)
+				if err != nil {
+					return fmt.Errorf("bad default: %w", err)
+				}
+			}
+
+		default:
+			return wrongTarget(field, ft)
 		}
 
 	default:
-		panic(fmt.Sprintf("Unsupported decode kind %v\n", ft.Kind))
+		return &TypeError{ fmt.Sprintf("Unsupported decode kind %v", ft.Kind) }
 	}
+
+	return nil
 }
 
+// wrongTarget reports a Go target that doesn't fit the spec.
+func wrongTarget(field interface{}, ft *fieldType) error {
+	return &TypeError{ fmt.Sprintf("Can't decode %s into %T", shapeText(ft), field) }
+}
 
-func encodeFixedSize(field interface{}, kind uint8, writer *bufio.Writer) {
 
-	// Deal with vague types from JSON data
-	switch field.(type) {
-	case int:
-		field = convertIntToFixedSize(field, reflect.Kind(kind))
-	case float64:
-		field = convertFloatToFixedSize(field, reflect.Kind(kind))
+// elem decodes a slice or map element of type typ; interface
+// types get map-mode values.
+func (d *decoder) elem(typ reflect.Type, ft *fieldType) (reflect.Value, error) {
+	if typ.Kind() != reflect.Interface {
+		var elemp = reflect.New(typ)
+		if err := d.decode(elemp.Interface(), ft); err != nil {
+			return reflect.Value{}, err
+		}
+		return elemp.Elem(), nil
 	}
 
-	var err = binary.Write(writer, binary.BigEndian, field)
-	if err != nil {
-		panic(fmt.Sprintf("Fixed size encode error: %v\n", err))
+	var elemp = createMapValue(ft)
+	if err := d.decode(elemp, ft); err != nil {
+		return reflect.Value{}, err
 	}
+	return enumMapValue(reflect.ValueOf(elemp).Elem(), ft), nil
 }
 
-func convertIntToFixedSize(field interface{}, kind reflect.Kind) interface{} {
-	var out interface{} = field
+var intType = reflect.TypeOf(0)
+var float64Type = reflect.TypeOf(float64(0))
 
-	switch kind {
-	case reflect.Int8: out = int8(field.(int))
-	case reflect.Int16: out = int16(field.(int))
-	case reflect.Int32: out = int32(field.(int))
-	case reflect.Int64: out = int64(field.(int))
-	case reflect.Uint8: out = uint8(field.(int))
-	case reflect.Uint16: out = uint16(field.(int))
-	case reflect.Uint32: out = uint32(field.(int))
-	case reflect.Uint64: out = uint64(field.(int))
+// fitInt and fitUint check a map-mode integer is in range for kind,
+// as assignNumber does for upgrades.
+func fitInt(i int64, kind reflect.Kind) (uint64, error) {
+	if kind >= reflect.Uint8 || reflect.Zero(kindTypes[kind]).OverflowInt(i) {
+		return 0, &TypeError{ fmt.Sprintf("%d overflows %v", i, kind) }
 	}
-	return out
+	return uint64(i), nil
 }
 
-func convertFloatToFixedSize(field interface{}, kind reflect.Kind) interface{} {
-	var out interface{} = field
+func fitUint(u uint64, kind reflect.Kind) (uint64, error) {
+	var zero = reflect.Zero(kindTypes[kind])
+	if kind >= reflect.Uint8 {
+		if zero.OverflowUint(u) {
+			return 0, &TypeError{ fmt.Sprintf("%d overflows %v", u, kind) }
+		}
+	} else if u > math.MaxInt64 || zero.OverflowInt(int64(u)) {
+		return 0, &TypeError{ fmt.Sprintf("%d overflows %v", u, kind) }
+	}
+	return u, nil
+}
+
+// appendFixedSize appends val big-endian as kind.
+func appendFixedSize(buf []byte, val reflect.Value, kind reflect.Kind) ([]byte, error) {
+	var sizedInt = kind >= reflect.Int8 && kind <= reflect.Uint64 && kind != reflect.Uint
+
+	// Map-mode nils
+	if !val.IsValid() {
+		return buf, &TypeError{ fmt.Sprintf("Can't encode %s as %v", valueType(val), kind) }
+	}
+
+	var bits uint64
+	switch {
+	case val.Kind() != kind:
+		// Deal with vague types from JSON data
+		var err error
+		switch {
+		case sizedInt && val.Type() == intType:
+			if i := val.Int(); i < 0 {
+				bits, err = fitInt(i, kind)
+			} else {
+				bits, err = fitUint(uint64(i), kind)
+			}
+		case sizedInt && val.Type() == float64Type:
+			var f = val.Float()
+			switch {
+			case f != math.Trunc(f) || math.IsInf(f, 0):
+				err = &TypeError{ fmt.Sprintf("%v is not an integer", f) }
+			case f < -(1 << 63) || f >= 1 << 64:
+				err = &TypeError{ fmt.Sprintf("%v overflows %v", f, kind) }
+			case f < 0:
+				bits, err = fitInt(int64(f), kind)
+			default:
+				bits, err = fitUint(uint64(f), kind)
+			}
+		default:
+			// Anything else must already be the right size
+			return buf, &TypeError{ fmt.Sprintf("Can't encode %s as %v", valueType(val), kind) }
+		}
+		if err != nil {
+			return buf, err
+		}
+	case val.CanInt():
+		bits = uint64(val.Int())
+	case val.CanUint():
+		bits = val.Uint()
+	case kind == reflect.Float32:
+		bits = uint64(math.Float32bits(float32(val.Float())))
+	case kind == reflect.Float64:
+		bits = math.Float64bits(val.Float())
+	case kind == reflect.Complex64:
+		var c = val.Complex()
+		bits = uint64(math.Float32bits(float32(real(c)))) << 32 | uint64(math.Float32bits(float32(imag(c))))
+	default:
+		var c = val.Complex()
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(real(c)))
+		bits = math.Float64bits(imag(c))
+	}
+
+	switch kindTypes[kind].Size() {
+	case 1:
+		return append(buf, byte(bits)), nil
+	case 2:
+		return binary.BigEndian.AppendUint16(buf, uint16(bits)), nil
+	case 4:
+		return binary.BigEndian.AppendUint32(buf, uint32(bits)), nil
+	}
+	return binary.BigEndian.AppendUint64(buf, bits), nil
+}
+
+// bulkKind is whether slices of kind are read and written in one go.
+func bulkKind(kind reflect.Kind) bool {
+	return kind >= reflect.Int8 && kind <= reflect.Uint64 && kind != reflect.Uint ||
+		kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// isByteSlice is whether map mode decodes ft as []byte. Enum elements
+// stay []interface{} so they can hold names.
+func isByteSlice(ft *fieldType) bool {
+	return reflect.Kind(ft.Kind) == reflect.Slice &&
+		reflect.Kind(ft.Elem[0].Kind) == reflect.Uint8 && ft.Elem[0].Enum == nil
+}
+
+// appendNumbers appends val, a slice of kind, big-endian.
+func appendNumbers(buf []byte, val reflect.Value, kind reflect.Kind) []byte {
+	var n = val.Len()
+	if kind == reflect.Uint8 {
+		return append(buf, val.Bytes()...)
+	}
+
+	var size = int(kindTypes[kind].Size())
+	var start = len(buf)
+	buf = append(buf, make([]byte, n * size)...)
+	var out = buf[start:]
 
 	switch kind {
-	case reflect.Int8: out = int8(int(field.(float64)))
-	case reflect.Int16: out = int16(int(field.(float64)))
-	case reflect.Int32: out = int32(int(field.(float64)))
-	case reflect.Int64: out = int64(int(field.(float64)))
-	case reflect.Uint8: out = uint8(int(field.(float64)))
-	case reflect.Uint16: out = uint16(int(field.(float64)))
-	case reflect.Uint32: out = uint32(int(field.(float64)))
-	case reflect.Uint64: out = uint64(int(field.(float64)))
+	case reflect.Int8:
+		for i := 0; i < n; i++ {
+			out[i] = byte(val.Index(i).Int())
+		}
+	case reflect.Int16:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint16(out[i * 2:], uint16(val.Index(i).Int()))
+		}
+	case reflect.Uint16:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint16(out[i * 2:], uint16(val.Index(i).Uint()))
+		}
+	case reflect.Int32:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint32(out[i * 4:], uint32(val.Index(i).Int()))
+		}
+	case reflect.Uint32:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint32(out[i * 4:], uint32(val.Index(i).Uint()))
+		}
+	case reflect.Int64:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint64(out[i * 8:], uint64(val.Index(i).Int()))
+		}
+	case reflect.Uint64:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint64(out[i * 8:], val.Index(i).Uint())
+		}
+	case reflect.Float32:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint32(out[i * 4:], math.Float32bits(float32(val.Index(i).Float())))
+		}
+	case reflect.Float64:
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint64(out[i * 8:], math.Float64bits(val.Index(i).Float()))
+		}
 	}
-	return out
+	return buf
 }
 
+// decodeNumbers reads count numbers of kind into slicev in one go,
+// into a new array unless ReuseSlices allows writing over its own.
+func (d *decoder) decodeNumbers(slicev reflect.Value, count uint64, kind reflect.Kind) error {
+	var size = uint64(kindTypes[kind].Size())
+	if count > math.MaxInt64 / size {
+		return &TypeError{ fmt.Sprintf("Length %d out of range", count) }
+	}
+
+	var aliased = kind == reflect.Uint8 && slicev.Type().Elem() == byteType &&
+		d.limits.AliasBytes && d.reader.reader == nil
+	if !aliased {
+		if err := d.alloc(count, slicev.Type().Elem()); err != nil {
+			return err
+		}
+	}
+
+	raw, err := d.reader.next(count * size)
+	if err != nil {
+		return readError("slice", err)
+	}
+
+	if aliased && count > 0 {
+		slicev.SetBytes(raw)
+		return nil
+	}
+
+	var n = int(count)
+	var out reflect.Value
+	// Empty slices write nothing, so keep nil as nil
+	if n == 0 || d.limits.ReuseSlices && slicev.Cap() >= n {
+		out = slicev.Slice(0, n)
+	} else {
+		out = reflect.MakeSlice(slicev.Type(), n, n)
+	}
+
+	switch kind {
+	case reflect.Uint8:
+		copy(out.Bytes(), raw)
+	case reflect.Int8:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetInt(int64(int8(raw[i])))
+		}
+	case reflect.Int16:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetInt(int64(int16(binary.BigEndian.Uint16(raw[i * 2:]))))
+		}
+	case reflect.Uint16:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetUint(uint64(binary.BigEndian.Uint16(raw[i * 2:])))
+		}
+	case reflect.Int32:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetInt(int64(int32(binary.BigEndian.Uint32(raw[i * 4:]))))
+		}
+	case reflect.Uint32:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetUint(uint64(binary.BigEndian.Uint32(raw[i * 4:])))
+		}
+	case reflect.Int64:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetInt(int64(binary.BigEndian.Uint64(raw[i * 8:])))
+		}
+	case reflect.Uint64:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetUint(binary.BigEndian.Uint64(raw[i * 8:]))
+		}
+	case reflect.Float32:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(raw[i * 4:]))))
+		}
+	case reflect.Float64:
+		for i := 0; i < n; i++ {
+			out.Index(i).SetFloat(math.Float64frombits(binary.BigEndian.Uint64(raw[i * 8:])))
+		}
+	}
+
+	slicev.Set(out)
+	return nil
+}
 
 func createMapValue(ft *fieldType) interface{} {
 	switch reflect.Kind(ft.Kind) {
@@ -567,6 +1654,10 @@ func createMapValue(ft *fieldType) interface{} {
 		return &val
 
 	case reflect.Slice:
+		if isByteSlice(ft) {
+			var val = make([]byte, 0)
+			return &val
+		}
 		var val = make([]interface{}, 0)
 		return &val
 
@@ -581,7 +1672,13 @@ func createMapValue(ft *fieldType) interface{} {
 	case STRUCT_REFERENCE:
 		var val = make(map[string]interface{})
 		return &val
+
+	case BIG_INT, BIG_FLOAT, BIG_RAT:
+		// Set to the number's string, or nil
+		var val interface{}
+		return &val
 	}
 
-	panic(fmt.Sprintf("Can't create map value for %v\n", ft))
+	// Unknown kinds fail when decoded
+	return nil
 }
\ No newline at end of file
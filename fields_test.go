@@ -5,11 +5,24 @@ import (
 
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
 	"reflect"
+	"strings"
+	"sync"
+	texttemplate "text/template"
 	_ "encoding/json"
 )
 
 
+// sameSpec compares the stored parts of specs.
+func sameSpec(a *TypeSpec, b *TypeSpec) bool {
+	return reflect.DeepEqual(a.Structs, b.Structs) && reflect.DeepEqual(a.Top, b.Top) &&
+		reflect.DeepEqual(a.Skipped, b.Skipped) && a.TrackRefs == b.TrackRefs
+}
+
 func TestFieldType(test *testing.T) {
 
 	type TypeTest struct {
@@ -232,6 +245,42 @@ func TestString(test *testing.T) {
 	tryString("Hello World")
 	tryString("世界您好")
 	tryString("")
+	tryString(strings.Repeat("長", 5000))
+}
+
+func TestStringBytes(test *testing.T) {
+	type pair struct {
+		A string
+		B string
+	}
+	var spec = MakeTypeSpec(pair{})
+
+	// Malformed bytes at the end mustn't swallow the next field
+	var orig = pair{ "a\xffb\xe2\x82", "next" }
+	var enc = mustEncode(test, spec, &orig)
+
+	var dec pair
+	var err = DecodeFromBytes(&dec, spec, enc)
+	if err != nil || dec != orig {
+		test.Errorf("Bytes not kept: %v %q", err, dec)
+	}
+
+	err = DecodeFromBytesWithOptions(&dec, spec, enc, DecodeOptions{ UTF8: UTF8Replace })
+	if err != nil || dec.A != "a\ufffdb\ufffd\ufffd" || dec.B != "next" {
+		test.Errorf("Wrong replacement: %v %q", err, dec)
+	}
+
+	err = DecodeFromBytesWithOptions(&dec, spec, enc, DecodeOptions{ UTF8: UTF8Strict })
+	var derr *DecodeError
+	if !errors.As(err, &derr) || derr.Path != "pair.A" {
+		test.Errorf("Invalid UTF-8 accepted: %v", err)
+	}
+
+	enc = mustEncode(test, spec, &pair{ "世界", "ok" })
+	err = DecodeFromBytesWithOptions(&dec, spec, enc, DecodeOptions{ UTF8: UTF8Strict })
+	if err != nil || dec.A != "世界" {
+		test.Errorf("Valid UTF-8 refused: %v %q", err, dec)
+	}
 }
 
 func TestByteSlice(test *testing.T) {
@@ -255,6 +304,206 @@ func TestByteSlice(test *testing.T) {
 	}
 }
 
+func TestNumericSlices(test *testing.T) {
+	type level int16
+	type numbers struct {
+		I8 []int8
+		I16 []int16
+		U16 []uint16
+		I32 []int32
+		U32 []uint32
+		I64 []int64
+		U64 []uint64
+		F32 []float32
+		F64 []float64
+		Levels []level
+		Data []byte
+	}
+
+	var orig = numbers{
+		[]int8{ -128, -1, 0, 127 },
+		[]int16{ -32768, -2, 300 },
+		[]uint16{ 0, 65535 },
+		[]int32{ -1 << 31, -3, 70000 },
+		[]uint32{ 1 << 31, 5 },
+		[]int64{ -1 << 63, -4, 1 << 40 },
+		[]uint64{ 1 << 63, 6 },
+		[]float32{ -1.5, 3.25 },
+		[]float64{ -2.5, 1e300 },
+		[]level{ -7, 7 },
+		[]byte{ 0, 1, 255 },
+	}
+	var spec = MakeTypeSpec(orig)
+	var enc = mustEncode(test, spec, &orig)
+
+	var dec numbers
+	if err := DecodeFromBytes(&dec, spec, enc); err != nil || !reflect.DeepEqual(dec, orig) {
+		test.Fatalf("Numeric slice mismatch: %v %v vs %v", err, dec, orig)
+	}
+
+	// Same bytes as element by element
+	var ints = []int32{ -1, 2, -70000 }
+	var loose = []interface{}{ int32(-1), int32(2), int32(-70000) }
+	var intSpec = MakeTypeSpec(ints)
+	if !bytes.Equal(mustEncode(test, intSpec, ints), mustEncode(test, intSpec, loose)) {
+		test.Errorf("Bulk encoding differs from per-element")
+	}
+
+	// Targets' memory is only reused on request
+	var into = make([]int32, 1, 10)
+	var held = into
+	if err := DecodeFromBytes(&into, intSpec, mustEncode(test, intSpec, ints)); err != nil ||
+		!reflect.DeepEqual(into, ints) || cap(into) == 10 || held[0] != 0 {
+		test.Errorf("Target reused: %v %v %v", err, into, held)
+	}
+
+	into = held
+	var opts = DecodeOptions{ ReuseSlices: true }
+	if err := DecodeFromBytesWithOptions(&into, intSpec, mustEncode(test, intSpec, ints), opts); err != nil ||
+		!reflect.DeepEqual(into, ints) || cap(into) != 10 || held[0] != -1 {
+		test.Errorf("Target not reused: %v %v", err, into)
+	}
+
+	// Aliased bytes decoded into again leave the input alone
+	var byteSpec = MakeTypeSpec([]byte{})
+	var input = mustEncode(test, byteSpec, []byte{ 1, 2, 3 })
+	var aliased []byte
+	if err := DecodeFromBytesWithOptions(&aliased, byteSpec, input, DecodeOptions{ AliasBytes: true }); err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+	var before = append([]byte(nil), input...)
+	if err := DecodeFromBytes(&aliased, byteSpec, mustEncode(test, byteSpec, []byte{ 9, 9, 9 })); err != nil ||
+		!bytes.Equal(input, before) {
+		test.Errorf("Aliased input overwritten: %v %x", err, input)
+	}
+
+	// Longer than the reader's buffer
+	var buf bytes.Buffer
+	var floats = make([]float64, 5000)
+	for i := range floats {
+		floats[i] = float64(i) / 3
+	}
+	var floatSpec = MakeTypeSpec(floats)
+	buf.Write(mustEncode(test, floatSpec, floats))
+	var decFloats []float64
+	if err := decodeField(&decFloats, floatSpec, bufio.NewReader(&buf)); err != nil || !reflect.DeepEqual(decFloats, floats) {
+		test.Errorf("Long float slice mismatch: %v", err)
+	}
+
+	var short = mustEncode(test, floatSpec, floats)[:100]
+	if err := DecodeFromBytes(&decFloats, floatSpec, short); !errors.Is(err, io.ErrUnexpectedEOF) {
+		test.Errorf("Truncated slice decoded: %v", err)
+	}
+
+	// Map mode gets bytes as []byte
+	var m = make(map[string]interface{})
+	if err := DecodeFromBytes(m, spec, enc); err != nil {
+		test.Fatalf("Map decoding error: %v", err)
+	}
+	if data, ok := m["Data"].([]byte); !ok || !bytes.Equal(data, orig.Data) {
+		test.Errorf("Map-mode bytes: %#v", m["Data"])
+	}
+	if nums, ok := m["I32"].([]interface{}); !ok || nums[0] != int32(-1 << 31) {
+		test.Errorf("Map-mode ints: %#v", m["I32"])
+	}
+	if reenc := mustEncode(test, spec, m); !bytes.Equal(reenc, enc) {
+		test.Errorf("Map-mode re-encoding differs")
+	}
+}
+
+
+func TestAliasing(test *testing.T) {
+	type blob struct {
+		Data []byte
+		Name string
+		Tags []string
+	}
+	var spec = MakeTypeSpec(blob{})
+	var orig = blob{ []byte{ 1, 2, 3 }, "name", []string{ "alpha", "beta", "gamma", "delta" } }
+
+	var enc = mustEncode(test, spec, &orig)
+	var opts = DecodeOptions{ AliasBytes: true, AliasStrings: true }
+
+	var dec blob
+	var err = DecodeFromBytesWithOptions(&dec, spec, enc, opts)
+	if err != nil || !reflect.DeepEqual(dec, orig) {
+		test.Fatalf("Wrong aliased decode: %v %v", err, dec)
+	}
+
+	// Bytes share the input, but can't be appended over the rest of it
+	enc[1] = 9
+	if dec.Data[0] != 9 || cap(dec.Data) != 3 {
+		test.Errorf("Bytes not aliased: %v", dec.Data)
+	}
+
+	// Strings share one copy, so don't see changes
+	enc[6] = 'N'
+	if dec.Name != "name" {
+		test.Errorf("String changed with input: %q", dec.Name)
+	}
+
+	var copied blob
+	err = DecodeFromBytes(&copied, spec, enc)
+	enc[1] = 7
+	if err != nil || copied.Data[0] != 9 {
+		test.Errorf("Bytes aliased by default: %v %v", err, copied.Data)
+	}
+
+	var plain = testing.AllocsPerRun(20, func() {
+		DecodeFromBytes(&dec, spec, enc)
+	})
+	var aliased = testing.AllocsPerRun(20, func() {
+		DecodeFromBytesWithOptions(&dec, spec, enc, opts)
+	})
+	if aliased > plain - 5 {
+		test.Errorf("Aliasing doesn't save allocations: %v vs %v", aliased, plain)
+	}
+}
+
+// Set by race_test.go; allocation counts aren't stable then
+var raceEnabled = false
+
+type appendRecord struct {
+	Name string
+	Age int32
+	Score float64
+	Active bool
+	Data []byte
+	Tags map[string]int32
+	Home *errAddress
+	Addresses []errAddress
+	Flags packedFlags
+}
+
+func TestAppendEncode(test *testing.T) {
+	var spec = MakeTypeSpec(appendRecord{})
+	var rec = appendRecord{
+		"ann", 42, 1.5, true, []byte{ 1, 2 }, map[string]int32{ "a": 1, "b": 2 },
+		&errAddress{ "s", "z" }, []errAddress{ { "a", "1" } }, packedFlags{ A: true, Level: 5, Name: "f" },
+	}
+
+	var buf, err = AppendEncode([]byte("prefix"), &rec, spec)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+	var dec appendRecord
+	if string(buf[:6]) != "prefix" || DecodeFromBytes(&dec, spec, buf[6:]) != nil || !reflect.DeepEqual(dec, rec) {
+		test.Errorf("Wrong append: %q %v", buf, dec)
+	}
+
+	var allocs = testing.AllocsPerRun(100, func() {
+		buf, err = AppendEncode(buf[:0], &rec, spec)
+	})
+	if err != nil || (allocs != 0 && !raceEnabled) {
+		test.Errorf("Encoding allocates: %v %v", allocs, err)
+	}
+
+	// Failures leave dst as it was
+	var bad = map[string]interface{}{ "Name": 7 }
+	if out, err := AppendEncode(buf[:3], bad, spec); err == nil || len(out) != 3 {
+		test.Errorf("Wrong failed append: %v %q", err, out)
+	}
+}
 
 func TestStringSlice(test *testing.T) {
 	var buf bytes.Buffer
@@ -825,8 +1074,53 @@ func TestMapAsStruct(test *testing.T) {
 }
 
 
+func TestMapNumberRange(test *testing.T) {
+	type Struct struct {
+		Small int8
+		Count uint32
+	}
+
+	var ft = MakeTypeSpec(Struct{})
+
+	for _, bad := range []map[string]interface{}{
+		{ "Small": 1.5, "Count": 0 },
+		{ "Small": 0, "Count": float64(1 << 40) },
+		{ "Small": 300, "Count": 0 },
+		{ "Small": 0, "Count": -1 },
+		{ "Small": 0, "Count": -1.0 },
+	} {
+		var _, err = EncodeToBytes(bad, ft)
+		var encErr *EncodeError
+		if !errors.As(err, &encErr) || !strings.HasPrefix(encErr.Path, "Struct.") {
+			test.Errorf("Out of range %v encoded: %v", bad, err)
+		}
+	}
+
+	// Map-mode nils are refused, not dereferenced
+	for _, bad := range []interface{}{ map[string]interface{}{ "Small": 0, "Count": nil }, nil } {
+		var spec = ft
+		if bad == nil {
+			spec = MakeTypeSpec(uint32(0))
+		}
+		var _, err = EncodeToBytes(bad, spec)
+		var encErr *EncodeError
+		if !errors.As(err, &encErr) || !strings.Contains(err.Error(), "Can't encode <nil>") {
+			test.Errorf("Nil encoded: %v", err)
+		}
+	}
+
+	var enc, err = EncodeToBytes(map[string]interface{}{ "Small": -128.0, "Count": 4294967295 }, ft)
+	var dec Struct
+	if err == nil {
+		err = DecodeFromBytes(&dec, ft, enc)
+	}
+	if err != nil || dec.Small != -128 || dec.Count != 4294967295 {
+		test.Errorf("Wrong in-range decode: %v %v", err, dec)
+	}
+}
+
 func kindType(kind reflect.Kind) *fieldType {
-	return &fieldType{ uint8(kind), []*fieldType{}, "", "" }
+	return &fieldType{ Kind: uint8(kind), Elem: []*fieldType{} }
 }
 
 func kindSpec(kind reflect.Kind) *TypeSpec {
@@ -835,3 +1129,554 @@ func kindSpec(kind reflect.Kind) *TypeSpec {
 		Top: kindType(kind),
 	}
 }
+
+
+func TestStructNameTag(test *testing.T) {
+	type Named struct {
+		_ struct{} `spack:"name=billing.Invoice"`
+		Amount uint32
+	}
+
+	var ft = MakeTypeSpec(Named{})
+
+	if ft.Top.StructName != "billing.Invoice" || len(ft.Structs["billing.Invoice"].Elem) != 1 {
+		test.Errorf("Wrong named spec: %v", ft.Top)
+	}
+
+	// Moved and renamed, but declaring the same stored name
+	type Moved struct {
+		_ struct{} `spack:"name=billing.Invoice"`
+		Amount uint32
+	}
+
+	var dec Moved
+	enc, err := EncodeToBytes(&Named{ Amount: 12 }, ft)
+	if err == nil {
+		err = DecodeFromBytes(&dec, ft, enc)
+	}
+
+	if err != nil || dec.Amount != 12 {
+		test.Errorf("Named struct decode failed: %v %v", err, dec)
+	}
+}
+
+func TestRelocatedStruct(test *testing.T) {
+	type Inner struct {
+		Zip uint32
+	}
+
+	type Original struct {
+		Name string
+		Age uint16
+		Home Inner
+		Gone string
+	}
+
+	var ft = MakeTypeSpec(Original{})
+	enc, err := EncodeToBytes(&Original{ "Brendon", 31, Inner{ 1234 }, "x" }, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	type OtherInner struct {
+		Zip uint32
+	}
+
+	// Different names, different order, a field dropped
+	type Relocated struct {
+		_ struct{} `spack:"allow_missing"`
+		Home OtherInner
+		Age uint16
+		Name string
+	}
+
+	var dec Relocated
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec.Name != "Brendon" || dec.Age != 31 || dec.Home.Zip != 1234 {
+		test.Errorf("Relocated decode failed: %v %#v", err, dec)
+	}
+
+	// Stored data is only dropped when asked
+	type Lossy struct {
+		Home OtherInner
+		Age uint16
+		Name string
+	}
+
+	var lossy Lossy
+	err = DecodeFromBytes(&lossy, ft, enc)
+	if err == nil || !strings.Contains(err.Error(), "Gone") {
+		test.Errorf("Stored field dropped silently: %v", err)
+	}
+
+	type Incompatible struct {
+		Name string
+		Age string
+	}
+
+	var bad Incompatible
+	err = DecodeFromBytes(&bad, ft, enc)
+	if err == nil {
+		test.Errorf("Incompatible struct decoded: %#v", bad)
+	}
+}
+
+func TestUnboundFields(test *testing.T) {
+	type A struct {
+		Name string
+	}
+	type B struct {
+		Name string
+		Extra string
+	}
+	type Ignored struct {
+		Name string
+		Extra string `spack:"ignore"`
+		hidden int
+	}
+
+	var ft = MakeTypeSpec(A{})
+
+	_, err := EncodeToBytes(&B{ "n", "lost" }, ft)
+	if err == nil || !strings.Contains(err.Error(), "Extra") {
+		test.Errorf("Unbound field dropped silently: %v", err)
+	}
+
+	enc, err := EncodeToBytes(&Ignored{ "n", "kept", 1 }, ft)
+	if err != nil || !bytes.Equal(enc, mustEncode(test, ft, &A{ "n" })) {
+		test.Errorf("Ignored fields refused: %v %x", err, enc)
+	}
+
+	// Decoding into more fields than were stored is fine
+	var dec B
+	if err = DecodeFromBytes(&dec, ft, enc); err != nil || dec.Name != "n" {
+		test.Errorf("Decoding error: %v", err)
+	}
+}
+
+func TestAnonymousStructs(test *testing.T) {
+	type Top struct {
+		One struct { Name string }
+		Two struct { Age uint32 }
+		Three struct { Name string }
+	}
+
+	var ft = MakeTypeSpec(Top{})
+	if len(ft.Structs) != 3 {
+		test.Errorf("Anonymous structs collided: %v", ft.Structs)
+	}
+
+	var st Top
+	st.One.Name = "one"
+	st.Two.Age = 2
+	st.Three.Name = "three"
+
+	var dec Top
+	enc, err := EncodeToBytes(&st, ft)
+	if err == nil {
+		err = DecodeFromBytes(&dec, ft, enc)
+	}
+
+	if err != nil || dec != st {
+		test.Errorf("Anonymous struct roundtrip failed: %v %#v", err, dec)
+	}
+
+	// Both are "struct { T *template.Template }" to Go
+	var text = structName(reflect.TypeOf(struct { T *texttemplate.Template }{}))
+	var html = structName(reflect.TypeOf(struct { T *template.Template }{}))
+	if text == html || text != "struct { T *text/template.Template }" {
+		test.Errorf("Anonymous structs from same-named packages collided: %s, %s", text, html)
+	}
+}
+
+type FlattenTestBase struct {
+	ID uint32
+	Name string
+}
+
+// Exported, since unexported embedded fields can't be stored unless
+// flattened, and encoding/json rules skip embedded pointers to them
+type FlattenTestExtra struct {
+	Note string
+}
+
+type _test_embed_top struct {
+	FlattenTestBase
+	*FlattenTestExtra
+	Name string
+}
+
+func TestFlattenEmbedded(test *testing.T) {
+	var nested = MakeTypeSpec(_test_embed_top{})
+	if len(nested.Structs) != 3 {
+		test.Errorf("Embedded structs not nested by default: %v", nested.Structs)
+	}
+
+	ft, err := MakeTypeSpecWithOptions(_test_embed_top{}, SpecOptions{ FlattenEmbedded: true })
+	if err != nil {
+		test.Fatalf("Spec error: %v", err)
+	}
+
+	var labels []string
+	for _, fieldFt := range ft.Structs[ft.Top.StructName].Elem {
+		labels = append(labels, fieldFt.Label)
+	}
+
+	if len(ft.Structs) != 1 || !reflect.DeepEqual(labels, []string{ "ID", "Note", "Name" }) {
+		test.Errorf("Wrong flattened fields: %v", labels)
+	}
+
+	var st = _test_embed_top{ Name: "outer" }
+	st.ID = 7
+	st.FlattenTestExtra = &FlattenTestExtra{ "note" }
+	st.FlattenTestBase.Name = "shadowed"
+
+	enc, err := EncodeToBytes(&st, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec _test_embed_top
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec.ID != 7 || dec.Name != "outer" || dec.FlattenTestExtra == nil || dec.Note != "note" {
+		test.Fatalf("Flattened roundtrip failed: %v %#v", err, dec)
+	}
+
+	// Nil embedded pointers encode as zero values
+	st.FlattenTestExtra = nil
+	_, err = EncodeToBytes(&st, ft)
+	if err != nil {
+		test.Errorf("Nil embedded pointer encoding error: %v", err)
+	}
+
+	var m = make(map[string]interface{})
+	err = DecodeFromBytes(m, ft, enc)
+	if err != nil || m["ID"] != uint32(7) || m["Name"] != "outer" || len(m) != 3 {
+		test.Errorf("Flattened map decode failed: %v %#v", err, m)
+	}
+}
+
+func TestUnsupportedFieldPolicy(test *testing.T) {
+	type Inner struct {
+		Count uint16
+		hidden string
+	}
+
+	type Holder struct {
+		Name string
+		mu sync.Mutex
+		Callback func()
+		Events chan int
+		Any interface{}
+		Nested Inner
+		Total int
+	}
+
+	_, err := MakeTypeSpecWithOptions(Holder{}, SpecOptions{})
+	if err == nil {
+		test.Errorf("Unexported field allowed by default")
+	}
+
+	var checkSkipped = func(ft *TypeSpec, want []string) {
+		if len(ft.Skipped) != len(want) {
+			test.Fatalf("Wrong skipped fields: %v", ft.Skipped)
+		}
+		for i, label := range want {
+			if !strings.Contains(ft.Skipped[i], "." + label + ": ") {
+				test.Errorf("Wrong skipped field %d: %s (want %s)", i, ft.Skipped[i], label)
+			}
+		}
+	}
+
+	// Exported fields lose data, so are always reported
+	ft, err := MakeTypeSpecWithOptions(Holder{}, SpecOptions{ Unsupported: FieldPolicySkip })
+	if err != nil {
+		test.Fatalf("Skip policy failed: %v", err)
+	}
+	checkSkipped(ft, []string{ "Callback", "Events", "Any", "Total" })
+
+	ft, err = MakeTypeSpecWithOptions(Holder{}, SpecOptions{ Unsupported: FieldPolicyWarn })
+	if err != nil {
+		test.Fatalf("Warn policy failed: %v", err)
+	}
+	checkSkipped(ft, []string{ "mu", "Callback", "Events", "Any", "hidden", "Total" })
+
+	var st = Holder{ Name: "held", Callback: func() {}, Nested: Inner{ 3, "secret" } }
+	enc, err := EncodeToBytes(&st, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec Holder
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec.Name != "held" || dec.Nested.Count != 3 || dec.Nested.hidden != "" || dec.Callback != nil {
+		test.Errorf("Skipped fields roundtrip failed: %v %#v", err, &dec)
+	}
+
+	// Non-struct unsupported kinds can't be skipped
+	_, err = MakeTypeSpecWithOptions(func() {}, SpecOptions{ Unsupported: FieldPolicySkip })
+	if err == nil {
+		test.Errorf("Top-level func allowed")
+	}
+}
+
+func TestFieldNumbers(test *testing.T) {
+	type Before struct {
+		_ struct{} `spack:"name=numbered"`
+		Name string `spack:"n=2"`
+		ID uint32 `spack:"n=1"`
+		Extra bool
+	}
+
+	type After struct {
+		_ struct{} `spack:"name=numbered"`
+		Flag bool
+		Extra bool
+		Ident uint32 `spack:"n=1"`
+		Name string `spack:"n=2"`
+	}
+
+	var ft = MakeTypeSpec(Before{})
+
+	var labels []string
+	for _, fieldFt := range ft.Structs["numbered"].Elem {
+		labels = append(labels, fmt.Sprintf("%s:%d", fieldFt.Label, fieldFt.Num))
+	}
+	if !reflect.DeepEqual(labels, []string{ "ID:1", "Name:2", "Extra:0" }) {
+		test.Errorf("Numbered fields not ordered: %v", labels)
+	}
+
+	enc, err := EncodeToBytes(&Before{ Name: "x", ID: 9, Extra: true }, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	// Reordered, renamed and inserted fields still decode
+	var dec After
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec.Ident != 9 || dec.Name != "x" || !dec.Extra || dec.Flag {
+		test.Errorf("Numbered fields decoded wrongly: %v %#v", err, dec)
+	}
+
+	type Dup struct {
+		A string `spack:"n=1"`
+		B string `spack:"n=1"`
+	}
+	type Bad struct {
+		A string `spack:"n=zero"`
+	}
+
+	_, err = MakeTypeSpecWithOptions(Dup{}, SpecOptions{})
+	if err == nil {
+		test.Errorf("Duplicate field number allowed")
+	}
+	_, err = MakeTypeSpecWithOptions(Bad{}, SpecOptions{})
+	if err == nil {
+		test.Errorf("Bad field number allowed")
+	}
+}
+
+func TestSparseStructs(test *testing.T) {
+	type Config struct {
+		_ struct{} `spack:"sparse"`
+		Host string
+		Port uint16
+		Debug bool
+		Tags []string
+		Limit *uint32
+	}
+
+	var ft = MakeTypeSpec(Config{})
+
+	var full, _ = EncodeToBytes(&Config{ Host: "h", Port: 80, Debug: true, Tags: []string{ "a" }, Limit: new(uint32) }, ft)
+	enc, err := EncodeToBytes(&Config{ Port: 8080 }, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	// Bitmap plus the port
+	if len(enc) != 3 || len(full) <= len(enc) {
+		test.Errorf("Zero fields not skipped: %v", enc)
+	}
+
+	var dec = Config{ Host: "stale" }
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec.Port != 8080 || dec.Host != "" {
+		test.Errorf("Sparse decode failed: %v %#v", err, dec)
+	}
+
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, ft, enc)
+	if err != nil || len(decMap) != 1 || decMap["Port"] != uint16(8080) {
+		test.Errorf("Absent fields in map: %v %v", err, decMap)
+	}
+
+	// Present-but-zero map entries survive
+	var src = map[string]interface{}{ "Host": "", "Port": 0 }
+	enc, err = EncodeToBytes(&src, ft)
+	decMap = make(map[string]interface{})
+	if err == nil {
+		err = DecodeFromBytes(&decMap, ft, enc)
+	}
+	if _, ok := decMap["Host"]; err != nil || !ok || len(decMap) != 2 {
+		test.Errorf("Explicit zero fields lost: %v %v", err, decMap)
+	}
+}
+
+func TestOptionalFields(test *testing.T) {
+	type Profile struct {
+		Name string
+		Nick string `spack:"optional"`
+		Age uint8
+	}
+
+	var ft = MakeTypeSpec(Profile{})
+
+	enc, err := EncodeToBytes(&Profile{ Name: "n" }, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, ft, enc)
+	if _, ok := decMap["Nick"]; err != nil || ok || len(decMap) != 2 {
+		test.Errorf("Optional field not omitted: %v %v", err, decMap)
+	}
+
+	var src = map[string]interface{}{ "Name": "n", "Nick": "", "Age": 3 }
+	enc, err = EncodeToBytes(&src, ft)
+	decMap = make(map[string]interface{})
+	if err == nil {
+		err = DecodeFromBytes(&decMap, ft, enc)
+	}
+	if nick, ok := decMap["Nick"]; err != nil || !ok || nick != "" {
+		test.Errorf("Explicit optional field lost: %v %v", err, decMap)
+	}
+
+	var dec Profile
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec != (Profile{ "n", "", 3 }) {
+		test.Errorf("Optional field decode failed: %v %#v", err, dec)
+	}
+}
+
+type refNode struct {
+	Name string
+	Next *refNode
+	Other *refNode
+}
+
+func TestCycleDetection(test *testing.T) {
+	var a = &refNode{ Name: "a" }
+	a.Next = &refNode{ Name: "b", Next: a }
+
+	var ft = MakeTypeSpec(refNode{})
+	var _, err = EncodeToBytes(a, ft)
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) || !strings.Contains(typeErr.Message, "Cycle detected") {
+		test.Errorf("Cycle not detected: %v", err)
+	}
+
+	// Shared but acyclic values are copied
+	var shared = &refNode{ Name: "s" }
+	enc, err := EncodeToBytes(&refNode{ "top", shared, shared }, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec refNode
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec.Next == dec.Other || dec.Next.Name != "s" || dec.Other.Name != "s" {
+		test.Errorf("Wrong shared decode: %v %v", err, dec)
+	}
+}
+
+type kidNode struct {
+	Name string `spack:"nonempty"`
+	Kids []kidNode
+	Named map[string]kidNode
+}
+
+func TestContainerCycles(test *testing.T) {
+	var ft = MakeTypeSpec(kidNode{})
+
+	var kids = make([]kidNode, 1)
+	kids[0] = kidNode{ Name: "a", Kids: kids }
+
+	var named = make(map[string]kidNode)
+	named["a"] = kidNode{ Name: "a", Named: named }
+
+	var obj = map[string]interface{}{ "Name": "a" }
+	obj["Kids"] = []interface{}{ obj }
+
+	for _, cyclic := range []interface{}{ &kids[0], &kidNode{ Name: "top", Named: named }, obj } {
+		var _, err = EncodeToBytes(cyclic, ft)
+		var typeErr *TypeError
+		if !errors.As(err, &typeErr) || !strings.Contains(typeErr.Message, "Cycle detected") {
+			test.Errorf("Cycle not detected: %v", err)
+		}
+		if err = ft.Validate(cyclic); err != nil {
+			test.Errorf("Validation error: %v", err)
+		}
+	}
+
+	// Repeated but acyclic containers are fine
+	var leaves = []kidNode{ { Name: "leaf" } }
+	var _, err = EncodeToBytes(&kidNode{ Name: "top", Kids: []kidNode{ { "x", leaves, nil }, { "y", leaves, nil } } }, ft)
+	if err != nil {
+		test.Errorf("Encoding error: %v", err)
+	}
+}
+
+func TestTrackRefs(test *testing.T) {
+	var ft, err = MakeTypeSpecWithOptions(refNode{}, SpecOptions{ TrackRefs: true })
+	if err != nil {
+		test.Fatalf("Spec error: %v", err)
+	}
+
+	var a = &refNode{ Name: "a" }
+	var b = &refNode{ Name: "b", Next: a, Other: a }
+	a.Next = b
+	a.Other = b
+
+	enc, err := EncodeToBytes(a, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	var dec refNode
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+	if dec.Next != dec.Other || dec.Next.Name != "b" || dec.Next.Next.Next != dec.Next {
+		test.Errorf("Identity not preserved: %v", dec)
+	}
+
+	// Map mode shares the decoded maps the same way
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, ft, enc)
+	if err != nil {
+		test.Fatalf("Map decoding error: %v", err)
+	}
+	var next, _ = decMap["Next"].(map[string]interface{})
+	var other, _ = decMap["Other"].(map[string]interface{})
+	if next == nil || reflect.ValueOf(next).Pointer() != reflect.ValueOf(other).Pointer() {
+		test.Errorf("Map identity not preserved: %v", decMap)
+	}
+
+	reenc, err := EncodeToBytes(&decMap, ft)
+	if err != nil || !bytes.Equal(reenc, enc) {
+		test.Errorf("Map re-encode differs: %v %x %x", err, reenc, enc)
+	}
+
+	// Plain specs refuse back-references
+	err = DecodeFromBytes(&dec, MakeTypeSpec(refNode{}), enc)
+	if err == nil {
+		test.Errorf("Back-reference accepted without TrackRefs")
+	}
+
+	if diffs := DiffSpecs(ft, MakeTypeSpec(refNode{})); len(diffs) != 1 {
+		test.Errorf("Wrong diffs: %v", diffs)
+	}
+}
@@ -0,0 +1,238 @@
+package spack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// ToJSON transcodes an encoded object (upgraded to the latest version)
+// to JSON, following the stored spec: enums are written by name and
+// map keys as strings.
+func (vt *VersionedType) ToJSON(encObj []byte) ([]byte, error) {
+	var obj, _, err = vt.DecodeObj(encObj, true)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := toMap(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec = vt.Versions[0].Spec
+	out, err := jsonOut(m, spec.Top, spec.Structs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
+// FromJSON encodes a JSON object as the latest version, accepting enum
+// names or numbers.
+func (vt *VersionedType) FromJSON(data []byte) ([]byte, error) {
+	if len(vt.Versions) == 0 {
+		return nil, &TypeError{ fmt.Sprintf("No versions registered for %s", vt.Name) }
+	}
+
+	var raw interface{}
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, &TypeError{ fmt.Sprintf("Bad JSON: %v", err) }
+	}
+
+	var spec = vt.Versions[0].Spec
+	var obj, err = jsonIn(raw, spec.Top, spec.Structs)
+	if err != nil {
+		return nil, err
+	}
+	return vt.EncodeObj(obj)
+}
+
+// jsonOut converts a map-mode value to what encoding/json can write.
+func jsonOut(val interface{}, ft *fieldType, structs structMap) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	switch reflect.Kind(ft.Kind) {
+	case reflect.Slice:
+		var sv = reflect.ValueOf(val)
+		var out = make([]interface{}, sv.Len())
+		for i := range out {
+			var elem, err = jsonOut(sv.Index(i).Interface(), ft.Elem[0], structs)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = elem
+		}
+		return out, nil
+
+	case reflect.Map:
+		var sv = reflect.ValueOf(val)
+		var out = make(map[string]interface{}, sv.Len())
+		var iter = sv.MapRange()
+		for iter.Next() {
+			var key, err = jsonOut(iter.Key().Interface(), ft.Elem[0], structs)
+			if err != nil {
+				return nil, err
+			}
+			elem, err := jsonOut(iter.Value().Interface(), ft.Elem[1], structs)
+			if err != nil {
+				return nil, err
+			}
+			out[fmt.Sprint(key)] = elem
+		}
+		return out, nil
+
+	case reflect.Ptr:
+		return jsonOut(val, ft.Elem[0], structs)
+
+	case STRUCT_REFERENCE:
+		var m, err = toMap(val)
+		if err != nil {
+			return nil, err
+		}
+		var structFt = structs[ft.StructName]
+		var out = make(map[string]interface{}, len(m))
+		for _, fieldFt := range structFt.Elem {
+			var fieldVal, ok = m[fieldFt.Label]
+			if !ok || reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+				continue
+			}
+			out[fieldFt.Label], err = jsonOut(fieldVal, fieldFt, structs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case reflect.Complex64, reflect.Complex128:
+		return fmt.Sprint(val), nil
+	}
+
+	return enumMapValue(reflect.ValueOf(val), ft).Interface(), nil
+}
+
+// jsonIn shapes decoded JSON into a map-mode value for the spec.
+func jsonIn(val interface{}, ft *fieldType, structs structMap) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	var kind = reflect.Kind(ft.Kind)
+
+	switch kind {
+	case reflect.Slice:
+		var list, ok = val.([]interface{})
+		if !ok {
+			return nil, &TypeError{ fmt.Sprintf("Expected a JSON array, got %T", val) }
+		}
+		var out = make([]interface{}, len(list))
+		for i, elem := range list {
+			var err error
+			out[i], err = jsonIn(elem, ft.Elem[0], structs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case reflect.Map:
+		var obj, ok = val.(map[string]interface{})
+		if !ok {
+			return nil, &TypeError{ fmt.Sprintf("Expected a JSON object, got %T", val) }
+		}
+		var out = make(map[interface{}]interface{}, len(obj))
+		for key, elem := range obj {
+			var k interface{} = key
+			if reflect.Kind(ft.Elem[0].Kind) != reflect.String {
+				var err error
+				k, err = jsonIn(json.Number(key), ft.Elem[0], structs)
+				if err != nil {
+					k, err = jsonIn(key, ft.Elem[0], structs)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			v, err := jsonIn(elem, ft.Elem[1], structs)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = v
+		}
+		return out, nil
+
+	case reflect.Ptr:
+		return jsonIn(val, ft.Elem[0], structs)
+
+	case STRUCT_REFERENCE:
+		var obj, ok = val.(map[string]interface{})
+		if !ok {
+			return nil, &TypeError{ fmt.Sprintf("Expected a JSON object, got %T", val) }
+		}
+		var out = make(map[string]interface{}, len(obj))
+		for _, fieldFt := range structs[ft.StructName].Elem {
+			var fieldVal, ok = obj[fieldFt.Label]
+			if !ok || reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+				continue
+			}
+			var err error
+			out[fieldFt.Label], err = jsonIn(fieldVal, fieldFt, structs)
+			if err != nil {
+				return nil, &TypeError{ fmt.Sprintf("%s: %v", fieldFt.Label, err) }
+			}
+		}
+		return out, nil
+
+	case reflect.Complex64, reflect.Complex128:
+		var str, _ = val.(string)
+		var c, err = strconv.ParseComplex(str, kindTypes[kind].Bits())
+		if err != nil {
+			return nil, &TypeError{ fmt.Sprintf("Bad complex number %v", val) }
+		}
+		return reflect.ValueOf(c).Convert(kindTypes[kind]).Interface(), nil
+
+	case BIG_INT, BIG_FLOAT, BIG_RAT:
+		// Numbers are kept as written, so nothing is lost to float64
+		var ptr, err = bigValue(val, kind)
+		if err != nil {
+			return nil, &TypeError{ err.Error() }
+		}
+		return ptr, nil
+	}
+
+	var target = kindTypes[kind]
+	if target == nil {
+		return nil, &TypeError{ fmt.Sprintf("Can't import JSON as %v", kindName(ft.Kind)) }
+	}
+
+	var out = reflect.New(target).Elem()
+	var src = val
+
+	if num, isNum := val.(json.Number); isNum {
+		if i, err := num.Int64(); err == nil {
+			src = i
+		} else if u, err := strconv.ParseUint(string(num), 10, 64); err == nil {
+			src = u
+		} else if f, err := num.Float64(); err == nil {
+			src = f
+		}
+	} else if name, isName := val.(string); isName && ft.Enum != nil {
+		var n, ok = enumNumber(ft.Enum, name)
+		if !ok {
+			return nil, &TypeError{ fmt.Sprintf("Unknown enum name %q", name) }
+		}
+		src = n
+	}
+
+	var err = assignValue(out, src)
+	if err != nil {
+		return nil, &TypeError{ err.Error() }
+	}
+	return out.Interface(), nil
+}
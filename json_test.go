@@ -0,0 +1,73 @@
+package spack
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(test *testing.T) {
+	type Order struct {
+		ID uint64
+		Color testColor
+		Counts map[uint16]string
+		Ratio *float32
+		Lines []string
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("order")
+	vt.AddVersion(0, Order{}, nil)
+
+	var ratio float32 = 0.25
+	enc, err := vt.EncodeObj(&Order{ 1 << 60, 1, map[uint16]string{ 3: "three" }, &ratio, []string{ "a" } })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	out, err := vt.ToJSON(enc)
+	if err != nil {
+		test.Fatalf("ToJSON error: %v", err)
+	}
+
+	var got, want interface{}
+	json.Unmarshal(out, &got)
+	json.Unmarshal([]byte(`{"ID":1152921504606846976,"Color":"green","Counts":{"3":"three"},"Ratio":0.25,"Lines":["a"]}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		test.Errorf("Wrong JSON: %s", out)
+	}
+
+	enc2, err := vt.FromJSON(out)
+	if err != nil || string(enc2) != string(enc) {
+		test.Errorf("JSON roundtrip failed: %v\n%v\n%v", err, enc2, enc)
+	}
+
+	// Enums by number work too
+	_, err = vt.FromJSON([]byte(`{"ID":1,"Color":2,"Counts":{},"Lines":[]}`))
+	if err != nil {
+		test.Errorf("Numeric enum refused: %v", err)
+	}
+
+	_, err = vt.FromJSON([]byte(`{"ID":1,"Color":"mauve","Counts":{},"Lines":[]}`))
+	if err == nil {
+		test.Errorf("Unknown enum name accepted")
+	}
+}
+
+func TestJSONNull(test *testing.T) {
+	type Person struct {
+		Name string
+		Age uint32
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("person")
+	vt.AddVersion(0, Person{}, nil)
+
+	var _, err = vt.FromJSON([]byte(`{"Name":"a","Age":null}`))
+	var encErr *EncodeError
+	if !errors.As(err, &encErr) || encErr.Path != "Person.Age" {
+		test.Errorf("Wrong error for null: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package spack
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// DEFAULT_MAX_DEPTH bounds nesting when DecodeOptions.MaxDepth is
+// zero, so deep input can't exhaust the stack.
+const DEFAULT_MAX_DEPTH = 10000
+
+// DEFAULT_MAX_EMPTY_ELEMS bounds elements decoded from no input when
+// DecodeOptions.MaxEmptyElems is zero, so a huge count of empty structs
+// can't keep decoding forever.
+const DEFAULT_MAX_EMPTY_ELEMS = 1 << 20
+
+// Largest buffer made up front from an unchecked length; longer values
+// grow as their bytes actually arrive.
+const maxPrealloc = 4096
+
+// DecodeOptions bounds what decoding untrusted input may use. Zero
+// fields are unlimited, except MaxDepth and MaxEmptyElems, which default
+// to DEFAULT_MAX_DEPTH and DEFAULT_MAX_EMPTY_ELEMS. Encoding is held to
+// those defaults too, so whatever encodes decodes without options.
+// Limits are checked before allocating for the value they cover.
+type DecodeOptions struct {
+	// Encoded bytes read
+	MaxBytes int64
+	// String bytes, slice elements and map entries per value
+	MaxStringLen uint64
+	MaxSliceLen uint64
+	MaxMapLen uint64
+	// Nested values: each struct, slice, map, pointer and leaf counts
+	MaxDepth int
+	// Slice elements and map entries read from no bytes, such as empty
+	// structs, across the whole value
+	MaxEmptyElems uint64
+	// Approximate bytes allocated for decoded values
+	MaxAlloc int64
+	// What to do with strings that aren't valid UTF-8
+	UTF8 UTF8Policy
+
+	// When decoding from a byte slice, []byte fields share its memory
+	// rather than being copied, so it mustn't change while they're in
+	// use.
+	AliasBytes bool
+	// When decoding from a byte slice, strings are cut from one copy
+	// of it rather than allocated one by one. Any string kept holds
+	// the whole copy in memory.
+	AliasStrings bool
+	// Numeric slices are decoded into the target's backing array when
+	// it's big enough, rather than a new one, so nothing else may be
+	// using that memory.
+	ReuseSlices bool
+}
+
+type UTF8Policy uint8
+
+const (
+	// UTF8Allow keeps strings' bytes as they are, so they round-trip
+	// exactly.
+	UTF8Allow UTF8Policy = iota
+	// UTF8Replace turns each invalid byte into U+FFFD.
+	UTF8Replace
+	// UTF8Strict fails on invalid UTF-8.
+	UTF8Strict
+)
+
+// LimitError reports input that would go over one of its
+// DecodeOptions.
+type LimitError struct {
+	Limit string
+	Value uint64
+	Max uint64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeded: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// checkLen rejects a length prefix over max, or one that can't be
+// held in an int.
+func checkLen(limit string, n uint64, max uint64) error {
+	if max > 0 && n > max {
+		return &LimitError{ limit, n, max }
+	}
+	if n > math.MaxInt {
+		return &TypeError{ fmt.Sprintf("Length %d out of range", n) }
+	}
+	return nil
+}
+
+// alloc charges count values of typ against the allocation budget.
+// Zero-size values still cost a byte, so the budget also bounds how
+// many can be decoded.
+func (d *decoder) alloc(count uint64, typ reflect.Type) error {
+	var size = uint64(1)
+	if typ != nil && typ.Size() > 0 {
+		size = uint64(typ.Size())
+	}
+	return d.allocBytes(count, size)
+}
+
+func (d *decoder) allocBytes(count uint64, size uint64) error {
+	if d.limits.MaxAlloc <= 0 {
+		return nil
+	}
+	var max = uint64(d.limits.MaxAlloc)
+	if count > max / size {
+		return &LimitError{ "MaxAlloc", count, max / size }
+	}
+	if d.allocated + count * size > max {
+		return &LimitError{ "MaxAlloc", d.allocated + count * size, max }
+	}
+	d.allocated += count * size
+	return nil
+}
+
+func (d *decoder) maxDepth() int {
+	if d.limits.MaxDepth > 0 {
+		return d.limits.MaxDepth
+	}
+	return DEFAULT_MAX_DEPTH
+}
+
+// emptyElem charges an element against MaxEmptyElems if nothing was
+// read for it since start. Other elements are bounded by the input.
+func (d *decoder) emptyElem(start int64) error {
+	if d.reader.offset != start {
+		return nil
+	}
+	var max = d.limits.MaxEmptyElems
+	if max == 0 {
+		max = DEFAULT_MAX_EMPTY_ELEMS
+	}
+	d.emptyElems++
+	if d.emptyElems > max {
+		return &LimitError{ "MaxEmptyElems", d.emptyElems, max }
+	}
+	return nil
+}
+
+// emptyElem is the encoder's side of the decoder's check, so it never
+// writes more empty elements than decoding accepts by default.
+func (e *encoder) emptyElem(start int) error {
+	if len(e.buf) != start {
+		return nil
+	}
+	e.emptyElems++
+	if e.emptyElems > DEFAULT_MAX_EMPTY_ELEMS {
+		return &LimitError{ "MaxEmptyElems", e.emptyElems, DEFAULT_MAX_EMPTY_ELEMS }
+	}
+	return nil
+}
+
+// prealloc is the capacity to make for a value of n items.
+func prealloc(n uint64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
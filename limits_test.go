@@ -0,0 +1,356 @@
+package spack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func limitHit(err error, limit string) bool {
+	var lerr *LimitError
+	return errors.As(err, &lerr) && lerr.Limit == limit
+}
+
+func uvarint(n uint64) []byte {
+	var buf = make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, n)]
+}
+
+func TestDecodeLimits(test *testing.T) {
+	// Huge lengths fail on the input, not on allocating for them
+	var str string
+	var err = DecodeFromBytes(&str, MakeTypeSpec(""), uvarint(1 << 60))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		test.Errorf("Wrong huge string error: %v", err)
+	}
+
+	var opts = DecodeOptions{ MaxStringLen: 10 }
+	err = DecodeFromBytesWithOptions(&str, MakeTypeSpec(""), mustEncode(test, MakeTypeSpec(""), strings.Repeat("x", 11)), opts)
+	if !limitHit(err, "MaxStringLen") {
+		test.Errorf("String limit not hit: %v", err)
+	}
+
+	// Empty elements take no input, so only the budget stops them
+	var empties []struct{}
+	opts = DecodeOptions{ MaxAlloc: 1 << 20 }
+	err = DecodeFromBytesWithOptions(&empties, MakeTypeSpec(empties), uvarint(1 << 40), opts)
+	var derr *DecodeError
+	if !limitHit(err, "MaxAlloc") || !errors.As(err, &derr) || derr.Offset != 6 {
+		test.Errorf("Allocation limit not hit: %v", err)
+	}
+
+	// ... or the empty element count
+	opts = DecodeOptions{ MaxEmptyElems: 10 }
+	if err = DecodeFromBytesWithOptions(&empties, MakeTypeSpec(empties), uvarint(1 << 60), opts); !limitHit(err, "MaxEmptyElems") {
+		test.Errorf("Empty element limit not hit: %v", err)
+	}
+	var emptyMap map[struct{}]struct{}
+	if err = DecodeFromBytesWithOptions(&emptyMap, MakeTypeSpec(emptyMap), uvarint(1 << 60), opts); !limitHit(err, "MaxEmptyElems") {
+		test.Errorf("Empty entry limit not hit: %v", err)
+	}
+	if err = DecodeFromBytesWithOptions(&empties, MakeTypeSpec(empties), uvarint(10), opts); err != nil || len(empties) != 10 {
+		test.Errorf("Empty element limit too strict: %v", err)
+	}
+
+	// Which has a default; start near it
+	var emptySpec = MakeTypeSpec(empties)
+	var d = newDecoder(emptySpec, nil, uvarint(2), DecodeOptions{})
+	d.emptyElems = DEFAULT_MAX_EMPTY_ELEMS - 1
+	if err = decodeTop(&empties, emptySpec, d); !limitHit(err, "MaxEmptyElems") {
+		test.Errorf("Default empty element limit not hit: %v", err)
+	}
+
+	var ints []int64
+	opts = DecodeOptions{ MaxSliceLen: 3 }
+	err = DecodeFromBytesWithOptions(&ints, MakeTypeSpec(ints), mustEncode(test, MakeTypeSpec(ints), []int64{ 1, 2, 3, 4 }), opts)
+	if !limitHit(err, "MaxSliceLen") {
+		test.Errorf("Slice limit not hit: %v", err)
+	}
+
+	var tags = map[string]int32{ "a": 1, "b": 2 }
+	var decTags map[string]int32
+	opts = DecodeOptions{ MaxMapLen: 1 }
+	err = DecodeFromBytesWithOptions(&decTags, MakeTypeSpec(tags), mustEncode(test, MakeTypeSpec(tags), tags), opts)
+	if !limitHit(err, "MaxMapLen") {
+		test.Errorf("Map limit not hit: %v", err)
+	}
+
+	var user = errUser{ Name: strings.Repeat("x", 100) }
+	var spec = MakeTypeSpec(user)
+	var enc = mustEncode(test, spec, &user)
+	opts = DecodeOptions{ MaxBytes: 50 }
+	if err = DecodeFromBytesWithOptions(&user, spec, enc, opts); !limitHit(err, "MaxBytes") {
+		test.Errorf("Byte limit not hit: %v", err)
+	}
+	opts = DecodeOptions{ MaxBytes: int64(len(enc)) }
+	if err = DecodeFromBytesWithOptions(&user, spec, enc, opts); err != nil {
+		test.Errorf("Byte limit too strict: %v", err)
+	}
+
+	var total big.Int
+	err = DecodeFromBytes(&total, MakeTypeSpec(total), append([]byte{ 1 }, uvarint(1 << 50)...))
+	if err == nil {
+		test.Errorf("Huge magnitude accepted")
+	}
+
+	// Map mode's decimal text is charged before it's made
+	var huge = new(big.Float).SetMantExp(big.NewFloat(1), 1 << 28)
+	var text interface{}
+	opts = DecodeOptions{ MaxStringLen: 1 << 12 }
+	err = DecodeFromBytesWithOptions(&text, MakeTypeSpec(huge), mustEncode(test, MakeTypeSpec(huge), huge), opts)
+	if !limitHit(err, "MaxStringLen") {
+		test.Errorf("Float text not limited: %v", err)
+	}
+}
+
+func TestDecodeDepth(test *testing.T) {
+	var spec = MakeTypeSpec(refNode{})
+
+	var chain = &refNode{ Name: "0" }
+	for i := 0; i < 20; i++ {
+		chain = &refNode{ Name: "n", Next: chain }
+	}
+	var enc = mustEncode(test, spec, chain)
+
+	var dec refNode
+	var err = DecodeFromBytesWithOptions(&dec, spec, enc, DecodeOptions{ MaxDepth: 10 })
+	var derr *DecodeError
+	if !limitHit(err, "MaxDepth") || !errors.As(err, &derr) || !strings.HasPrefix(derr.Path, "refNode.Next.Next") {
+		test.Errorf("Depth limit not hit: %v", err)
+	}
+	if err = DecodeFromBytes(&dec, spec, enc); err != nil {
+		test.Errorf("Decoding error: %v", err)
+	}
+
+	// Nesting is bounded even without options
+	var deep = bytes.Repeat([]byte{ 0, 1 }, DEFAULT_MAX_DEPTH)
+	if err = DecodeFromBytes(&dec, spec, deep); !limitHit(err, "MaxDepth") {
+		test.Errorf("Default depth limit not hit: %v", err)
+	}
+
+	// ... and encoding to the same bound, so whatever encodes decodes
+	for i := 0; i < DEFAULT_MAX_DEPTH / 2 - 30; i++ {
+		chain = &refNode{ Name: "n", Next: chain }
+	}
+	enc = mustEncode(test, spec, chain)
+	if err = DecodeFromBytes(&dec, spec, enc); err != nil {
+		test.Errorf("Deep decoding error: %v", err)
+	}
+	var deeper = &refNode{ Name: "n", Next: chain }
+	for i := 0; i < 20; i++ {
+		deeper = &refNode{ Name: "n", Next: deeper }
+	}
+	if _, err = EncodeToBytes(deeper, spec); !limitHit(err, "MaxDepth") {
+		test.Errorf("Encoding depth limit not hit: %v", err)
+	}
+
+	// Deep paths are elided in errors
+	err = DecodeFromBytesWithOptions(&dec, spec, enc, DecodeOptions{ MaxDepth: 1000 })
+	if !limitHit(err, "MaxDepth") || !errors.As(err, &derr) ||
+		!strings.Contains(derr.Path, "more)...") || len(derr.Path) > 1000 {
+		test.Errorf("Deep path not elided: %v", err)
+	}
+}
+
+func TestEncodeLimits(test *testing.T) {
+	// Encoding stops where decoding would by default; start near it
+	var empties = make([]struct{}, 2)
+	var spec = MakeTypeSpec(empties)
+	var e = getEncoder(spec, nil)
+	e.emptyElems = DEFAULT_MAX_EMPTY_ELEMS - 1
+	var err = e.run(empties, spec)
+	e.release()
+	if !limitHit(err, "MaxEmptyElems") {
+		test.Errorf("Encoding empty element limit not hit: %v", err)
+	}
+
+	if _, err = EncodeToBytes(empties, spec); err != nil {
+		test.Errorf("Encoding error: %v", err)
+	}
+}
+
+func TestLoadTypeSetLimits(test *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(typeSetMagic)
+	buf.Write(uvarint(1))
+	buf.Write(uvarint(1))
+	buf.Write(uvarint(1 << 30))
+
+	if _, err := LoadTypeSet(&buf); err == nil {
+		test.Errorf("Loaded truncated type set")
+	}
+}
+
+var fuzzOptions = DecodeOptions{ MaxBytes: 1 << 16, MaxStringLen: 1 << 12, MaxDepth: 100, MaxAlloc: 1 << 20 }
+
+// fuzzSeeds encodes values from the other tests.
+func fuzzSeeds(fuzz *testing.F, spec *TypeSpec, values ...interface{}) {
+	for _, val := range values {
+		var enc, err = EncodeToBytes(val, spec)
+		if err != nil {
+			fuzz.Fatalf("Seed encoding error: %v", err)
+		}
+		fuzz.Add(enc)
+	}
+}
+
+// The shapes fields_test.go and types_test.go encode, for seeds
+type fuzzPerson struct {
+	Name string
+	Age uint32
+}
+
+type fuzzPeople struct {
+	Embed fuzzPerson
+	Ref *fuzzPerson
+	Embeds []fuzzPerson
+	Refs []*fuzzPerson
+	Missing *fuzzPerson
+	Stuff []int32
+}
+
+type fuzzRecursive struct {
+	Name string
+	Rec *fuzzRecursive
+}
+
+type fuzzMapField struct {
+	Map map[string]string
+}
+
+type fuzzSpecSource struct {
+	Name string
+	Age uint32
+	Self *fuzzSpecSource
+	Mutual *_test_mutual_A
+}
+
+type fuzzObj struct {
+	Name string
+	Ignored string `spack:"ignore"`
+	Another string
+}
+
+type fuzzObj1 struct {
+	Name string
+	Age uint16
+}
+
+// fuzzFixtures returns pointers to one value of each test shape.
+func fuzzFixtures() []interface{} {
+	var brendon = fuzzPerson{ "Brendon", 31 }
+	return []interface{}{
+		&brendon,
+		&fuzzPeople{
+			Embed: brendon,
+			Ref: &brendon,
+			Embeds: []fuzzPerson{ brendon, { "Ben", 26 }, { "Nai", 32 } },
+			Refs: []*fuzzPerson{ &brendon, { "Ben", 26 }, nil },
+		},
+		&fuzzRecursive{ "One", &fuzzRecursive{ "Two", &fuzzRecursive{ "Three", nil } } },
+		&_test_mutual_A{ "A1", &_test_mutual_B{ "B1", &_test_mutual_A{ "A2", &_test_mutual_B{ "B2", nil } } } },
+		&map[string]*fuzzPerson{ "Brend": &brendon, "Nai": { "Nai Yu", 32 } },
+		&fuzzMapField{ map[string]string{ "One": "Two", "Three": "Four" } },
+		&fuzzMapField{},
+		MakeTypeSpec(fuzzSpecSource{}),
+		&fuzzObj{ "Obj", "Nothing", "Something" },
+		&fuzzObj1{ "Obj2", 2 },
+	}
+}
+
+func FuzzDecodeFromBytes(fuzz *testing.F) {
+	var userSpec = MakeTypeSpec(errUser{})
+	var bigSpec = MakeTypeSpec(bigInvoice{})
+	var flagSpec = MakeTypeSpec(packedFlags{})
+	var refSpec, _ = MakeTypeSpecWithOptions(refNode{}, SpecOptions{ TrackRefs: true })
+
+	var shared = &refNode{ Name: "s" }
+	var total, _ = new(big.Int).SetString("-123456789012345678901234567890", 10)
+
+	fuzzSeeds(fuzz, userSpec,
+		&errUser{ "ann", []errAddress{ { "a", "1" }, { "b", "22" } }, map[string]int32{ "x": 1 } },
+		&errUser{ Name: "héllo" })
+	fuzzSeeds(fuzz, bigSpec,
+		&bigInvoice{ Total: total, Rate: *big.NewRat(-7, 12), Scale: big.NewFloat(3.5), Parts: []*big.Int{ nil, big.NewInt(1) } })
+	fuzzSeeds(fuzz, flagSpec, &packedFlags{})
+	fuzzSeeds(fuzz, refSpec, &refNode{ "top", shared, shared })
+
+	var fixtures = fuzzFixtures()
+	var fixtureSpecs = make([]*TypeSpec, len(fixtures))
+	for i, fixture := range fixtures {
+		var val = reflect.ValueOf(fixture).Elem().Interface()
+		fixtureSpecs[i] = MakeTypeSpec(val)
+		fuzzSeeds(fuzz, fixtureSpecs[i], val)
+	}
+
+	fuzz.Fuzz(func(test *testing.T, data []byte) {
+		var user errUser
+		if DecodeFromBytesWithOptions(&user, userSpec, data, fuzzOptions) == nil {
+			if _, err := EncodeToBytes(&user, userSpec); err != nil {
+				test.Errorf("Decoded user doesn't encode: %v", err)
+			}
+		}
+
+		var inv bigInvoice
+		DecodeFromBytesWithOptions(&inv, bigSpec, data, fuzzOptions)
+		var flags packedFlags
+		DecodeFromBytesWithOptions(&flags, flagSpec, data, fuzzOptions)
+		var node refNode
+		DecodeFromBytesWithOptions(&node, refSpec, data, fuzzOptions)
+
+		for i, spec := range fixtureSpecs {
+			var target = reflect.New(reflect.TypeOf(fixtures[i]).Elem())
+			DecodeFromBytesWithOptions(target.Interface(), spec, data, fuzzOptions)
+		}
+
+		for _, spec := range append([]*TypeSpec{ userSpec, bigSpec, flagSpec, refSpec }, fixtureSpecs...) {
+			if reflect.Kind(spec.Top.Kind) == STRUCT_REFERENCE {
+				DecodeFromBytesWithOptions(make(map[string]interface{}), spec, data, fuzzOptions)
+			}
+		}
+	})
+}
+
+func FuzzDecodeObj(fuzz *testing.F) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+	vt.AddVersion(0, errUser{}, nil)
+	vt.AddVersion(1, constrainedUser{}, func(obj interface{}) (interface{}, error) {
+		return obj, nil
+	})
+	vt.DecodeOptions = fuzzOptions
+
+	for _, obj := range []interface{}{ &constrainedUser{}, &errUser{ Name: "ann", Tags: map[string]int32{ "x": 1 } } } {
+		var enc, err = EncodeToBytes(obj, MakeTypeSpec(obj))
+		if err != nil {
+			fuzz.Fatalf("Seed encoding error: %v", err)
+		}
+		fuzz.Add(append([]byte{ 0, 1 }, enc...))
+		fuzz.Add(append([]byte{ 0, 0 }, enc...))
+	}
+
+	// As in TestEncodeObj
+	var objType = ts.RegisterType("test")
+	objType.DecodeOptions = fuzzOptions
+	for i, obj := range []interface{}{ &fuzzObj{ "Obj", "Nothing", "Something" }, &fuzzObj1{ "Obj2", 2 } } {
+		objType.AddVersion(uint16(i), reflect.ValueOf(obj).Elem().Interface(), nil)
+		var enc, err = objType.EncodeObj(obj)
+		if err != nil {
+			fuzz.Fatalf("Seed encoding error: %v", err)
+		}
+		fuzz.Add(enc)
+	}
+
+	fuzz.Fuzz(func(test *testing.T, data []byte) {
+		for _, vt := range []*VersionedType{ vt, objType } {
+			vt.DecodeObj(data, false)
+			vt.DecodeObj(data, true)
+			vt.DecodeInto(data, make(map[string]interface{}))
+		}
+	})
+}
@@ -0,0 +1,329 @@
+package spack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The lock file is a readable, diffable record of every registered
+// type, its tag and the spec of each version, meant to be checked in
+// so CI can fail when the registered types drift from it:
+//
+//   type "user" 2
+//     version 1
+//       top struct example.com/app/User
+//       struct example.com/app/User
+//         Name string
+//         Age uint16
+//   tombstone "session" 3
+//   last tag 3
+//
+// The internal _type is left out, since its layouts belong to the
+// library rather than the application.
+
+const lockHeader = "# spack schema lock; regenerate with TypeSet.WriteLock"
+
+func (ts *TypeSet) WriteLock(w io.Writer) error {
+	var writer = bufio.NewWriter(w)
+	fmt.Fprintln(writer, lockHeader)
+
+	for _, vt := range ts.lockedTypes() {
+		fmt.Fprintf(writer, "type %s %d\n", strconv.Quote(vt.Name), vt.Tag)
+		for i := len(vt.Versions) - 1; i >= 0; i-- {
+			var v = vt.Versions[i]
+			fmt.Fprintf(writer, "  version %d\n", v.Version)
+			for _, line := range specText(v.Spec) {
+				fmt.Fprintf(writer, "    %s\n", line)
+			}
+		}
+	}
+
+	for _, vt := range ts.sortedTombstones() {
+		fmt.Fprintf(writer, "tombstone %s %d\n", strconv.Quote(vt.Name), vt.Tag)
+	}
+	fmt.Fprintf(writer, "last tag %d\n", ts.LastTag)
+
+	return writer.Flush()
+}
+
+// lockedTypes is sortedTypes without _type.
+func (ts *TypeSet) lockedTypes() []*VersionedType {
+	var types []*VersionedType
+	for _, vt := range ts.sortedTypes() {
+		if vt.Name != "_type" {
+			types = append(types, vt)
+		}
+	}
+	return types
+}
+
+func (ts *TypeSet) sortedTombstones() []*VersionedType {
+	var types = make([]*VersionedType, 0, len(ts.Tombstones))
+	for _, vt := range ts.Tombstones {
+		types = append(types, vt)
+	}
+	sortByTag(types)
+	return types
+}
+
+// CheckLock compares the registered types with a lock file written by
+// WriteLock, returning an error describing every divergence.
+func (ts *TypeSet) CheckLock(r io.Reader) error {
+	lock, err := readLock(r)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	var locked = lock.types
+
+	for _, vt := range ts.lockedTypes() {
+		var lt, ok = locked[vt.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("type %s: registered but not in lock", vt.Name))
+			continue
+		}
+
+		if lt.tag != vt.Tag {
+			problems = append(problems, fmt.Sprintf("type %s: tag %d in lock, %d registered", vt.Name, lt.tag, vt.Tag))
+		}
+
+		for i := len(vt.Versions) - 1; i >= 0; i-- {
+			var v = vt.Versions[i]
+			var lines, ok = lt.versions[v.Version]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("type %s version %d: registered but not in lock", vt.Name, v.Version))
+				continue
+			}
+			var diff = diffLines(lines, specText(v.Spec))
+			if diff != "" {
+				problems = append(problems, fmt.Sprintf("type %s version %d: spec differs: %s", vt.Name, v.Version, diff))
+			}
+		}
+
+		for version := range lt.versions {
+			if vt.GetVersion(version) == nil {
+				problems = append(problems, fmt.Sprintf("type %s version %d: in lock but not registered", vt.Name, version))
+			}
+		}
+	}
+
+	for name := range locked {
+		if _, ok := ts.Types[name]; !ok {
+			problems = append(problems, fmt.Sprintf("type %s: in lock but not registered", name))
+		}
+	}
+
+	for _, vt := range ts.sortedTombstones() {
+		if name, ok := lock.tombstones[vt.Tag]; !ok || name != vt.Name {
+			problems = append(problems, fmt.Sprintf("tombstone %s %d: registered but not in lock", vt.Name, vt.Tag))
+		}
+	}
+	for tag, name := range lock.tombstones {
+		if vt := ts.Tombstones[tag]; vt == nil || vt.Name != name {
+			problems = append(problems, fmt.Sprintf("tombstone %s %d: in lock but not registered", name, tag))
+		}
+	}
+
+	// Locks from before tombstones were recorded lack the last tag
+	if lock.hasLastTag && lock.lastTag != ts.LastTag {
+		problems = append(problems, fmt.Sprintf("last tag: %d in lock, %d registered", lock.lastTag, ts.LastTag))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &TypeError{ "Registered types don't match schema lock:\n  " + strings.Join(problems, "\n  ") }
+	}
+
+	return nil
+}
+
+type lockFile struct {
+	types map[string]*lockedType
+	tombstones map[uint16]string
+	lastTag uint16
+	hasLastTag bool
+}
+
+type lockedType struct {
+	tag uint16
+	versions map[uint16][]string
+}
+
+func readLock(r io.Reader) (*lockFile, error) {
+	var lock = &lockFile{ types: make(map[string]*lockedType), tombstones: make(map[uint16]string) }
+	var locked = lock.types
+	var cur *lockedType
+	var curVersion = -1
+	var lineNo = 0
+
+	var scanner = bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		var line = scanner.Text()
+
+		switch {
+		case strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#"):
+
+		case strings.HasPrefix(line, "type "):
+			var idx = strings.LastIndex(line, " ")
+			if idx <= 5 {
+				return nil, &TypeError{ fmt.Sprintf("Bad type line %d in lock: %s", lineNo, line) }
+			}
+			name, err := strconv.Unquote(line[5:idx])
+			tag, err2 := strconv.ParseUint(line[idx+1:], 10, 16)
+			if err != nil || err2 != nil || name == "" {
+				return nil, &TypeError{ fmt.Sprintf("Bad type line %d in lock: %s", lineNo, line) }
+			}
+			cur = &lockedType{ uint16(tag), make(map[uint16][]string) }
+			locked[name] = cur
+			curVersion = -1
+
+		case strings.HasPrefix(line, "tombstone "):
+			var idx = strings.LastIndex(line, " ")
+			if idx <= 10 {
+				return nil, &TypeError{ fmt.Sprintf("Bad tombstone line %d in lock: %s", lineNo, line) }
+			}
+			name, err := strconv.Unquote(line[10:idx])
+			tag, err2 := strconv.ParseUint(line[idx+1:], 10, 16)
+			if err != nil || err2 != nil || name == "" {
+				return nil, &TypeError{ fmt.Sprintf("Bad tombstone line %d in lock: %s", lineNo, line) }
+			}
+			lock.tombstones[uint16(tag)] = name
+			cur = nil
+			curVersion = -1
+
+		case strings.HasPrefix(line, "last tag "):
+			tag, err := strconv.ParseUint(line[9:], 10, 16)
+			if err != nil {
+				return nil, &TypeError{ fmt.Sprintf("Bad last tag line %d in lock: %s", lineNo, line) }
+			}
+			lock.lastTag = uint16(tag)
+			lock.hasLastTag = true
+			cur = nil
+			curVersion = -1
+
+		case strings.HasPrefix(line, "  version "):
+			version, err := strconv.ParseUint(line[10:], 10, 16)
+			if err != nil || cur == nil {
+				return nil, &TypeError{ fmt.Sprintf("Bad version line %d in lock: %s", lineNo, line) }
+			}
+			curVersion = int(version)
+			cur.versions[uint16(version)] = make([]string, 0)
+
+		case strings.HasPrefix(line, "    "):
+			if curVersion < 0 {
+				return nil, &TypeError{ fmt.Sprintf("Spec line %d outside a version in lock", lineNo) }
+			}
+			var v = uint16(curVersion)
+			cur.versions[v] = append(cur.versions[v], line[4:])
+
+		default:
+			return nil, &TypeError{ fmt.Sprintf("Bad line %d in lock: %s", lineNo, line) }
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, &TypeError{ fmt.Sprintf("Error reading lock: %v", err) }
+	}
+
+	return lock, nil
+}
+
+func diffLines(locked []string, current []string) string {
+	for i := 0; i < len(locked) || i < len(current); i++ {
+		switch {
+		case i >= len(current):
+			return fmt.Sprintf("lock has %q", locked[i])
+		case i >= len(locked):
+			return fmt.Sprintf("registered has %q", current[i])
+		case locked[i] != current[i]:
+			return fmt.Sprintf("lock has %q, registered has %q", locked[i], current[i])
+		}
+	}
+	return ""
+}
+
+// specText renders a spec canonically, one line per struct field.
+func specText(spec *TypeSpec) []string {
+	var lines = []string{ "top " + fieldTypeText(spec.Top) }
+	if spec.TrackRefs {
+		lines = append(lines, "refs tracked")
+	}
+
+	var names = make([]string, 0, len(spec.Structs))
+	for name := range spec.Structs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var structFt = spec.Structs[name]
+		var line = "struct " + name
+		if structFt.Flags != 0 {
+			line += " " + flagsText(structFt.Flags)
+		}
+		lines = append(lines, line)
+
+		for _, fieldFt := range structFt.Elem {
+			var line = "  " + fieldFt.Label + " " + fieldTypeText(fieldFt)
+			if fieldFt.Num != 0 {
+				line += fmt.Sprintf(" n=%d", fieldFt.Num)
+			}
+			if fieldFt.Bits != 0 {
+				line += fmt.Sprintf(" bits=%d", fieldFt.Bits)
+			}
+			if fieldFt.Flags != 0 {
+				line += " " + flagsText(fieldFt.Flags)
+			}
+			for _, rule := range fieldFt.Rules {
+				line += " " + strconv.Quote(rule)
+			}
+			if fieldFt.Default != nil {
+				if text, ok := defaultTagText(fieldFt); ok {
+					line += " default=" + strconv.Quote(text)
+				} else {
+					line += fmt.Sprintf(" default=%x", fieldFt.Default)
+				}
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func fieldTypeText(ft *fieldType) string {
+	return typeText(ft, true)
+}
+
+// shapeText is fieldTypeText without enum names.
+func shapeText(ft *fieldType) string {
+	return typeText(ft, false)
+}
+
+func typeText(ft *fieldType, enums bool) string {
+	switch reflect.Kind(ft.Kind) {
+	case reflect.Slice:
+		return "[]" + typeText(ft.Elem[0], enums)
+	case reflect.Ptr:
+		return "*" + typeText(ft.Elem[0], enums)
+	case reflect.Map:
+		return "map[" + typeText(ft.Elem[0], enums) + "]" + typeText(ft.Elem[1], enums)
+	case STRUCT_REFERENCE:
+		return "struct " + ft.StructName
+	}
+	if enums && ft.Enum != nil {
+		var names = make([]string, 0, len(ft.Enum))
+		for _, ev := range ft.Enum {
+			names = append(names, fmt.Sprintf("%s=%d", ev.Name, ev.Value))
+		}
+		return kindName(ft.Kind) + " enum(" + strings.Join(names, " ") + ")"
+	}
+	return kindName(ft.Kind)
+}
@@ -0,0 +1,208 @@
+package spack
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// tagBits reads a `spack:"bits=N"` width for an unsigned int field.
+func tagBits(text string, ft *fieldType, packed bool) (uint8, error) {
+	var kind = reflect.Kind(ft.Kind)
+	if kind < reflect.Uint8 || kind > reflect.Uint64 {
+		return 0, fmt.Errorf("needs an unsigned int, not %v", kind)
+	}
+	if !packed {
+		return 0, fmt.Errorf("needs a packed struct")
+	}
+	var n, err = strconv.ParseUint(text, 10, 8)
+	if err != nil || n == 0 || int(n) > kindTypes[kind].Bits() {
+		return 0, fmt.Errorf("%q is not a width from 1 to %d", text, kindTypes[kind].Bits())
+	}
+	return uint8(n), nil
+}
+
+// structFields encodes the present fields of a struct in order.
+func (e *encoder) structFields(structFt *fieldType, vals []reflect.Value, present []bool) error {
+	var packed = structFt.Flags & FLAG_PACKED != 0
+	var bits bitset
+
+	for i, fieldFt := range structFt.Elem {
+		if !present[i] || reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			continue
+		}
+		if packed && packedWidth(fieldFt) > 0 {
+			var n, err = packValue(vals[i], fieldFt)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fieldFt.Label, err)
+			}
+			e.buf = bits.put(e.buf, n, packedWidth(fieldFt))
+			continue
+		}
+		bits.pos = 0
+		if err := e.encode(vals[i], fieldFt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// structFields decodes the present fields of a struct into their
+// targets, which are pointers.
+func (d *decoder) structFields(structFt *fieldType, targets []interface{}, present []bool) error {
+	var packed = structFt.Flags & FLAG_PACKED != 0
+	var bits bitset
+	var inRun = false
+
+	for i, fieldFt := range structFt.Elem {
+		if !present[i] || reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			continue
+		}
+
+		var width = packedWidth(fieldFt)
+		if !packed || width == 0 {
+			inRun = false
+			if err := d.decode(targets[i], fieldFt); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !inRun {
+			if err := bits.read(d.reader, runWidth(structFt, present, i)); err != nil {
+				return err
+			}
+			inRun = true
+		}
+		if err := unpackValue(targets[i], bits.take(width)); err != nil {
+			return fmt.Errorf("%s: %w", fieldFt.Label, err)
+		}
+	}
+
+	return nil
+}
+
+// runWidth adds up the bits of the packed run starting at field start.
+func runWidth(structFt *fieldType, present []bool, start int) uint {
+	var total uint
+	for i := start; i < len(structFt.Elem); i++ {
+		var fieldFt = structFt.Elem[i]
+		if !present[i] || reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			continue
+		}
+		var width = packedWidth(fieldFt)
+		if width == 0 {
+			break
+		}
+		total += width
+	}
+	return total
+}
+
+// packedWidth is how many bits a field takes in a packed struct, or 0
+// if it's encoded normally.
+func packedWidth(ft *fieldType) uint {
+	switch reflect.Kind(ft.Kind) {
+	case reflect.Bool:
+		return 1
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uint(ft.Bits)
+	}
+	return 0
+}
+
+func packValue(rv reflect.Value, ft *fieldType) (uint64, error) {
+	for rv.Kind() == reflect.Interface {
+		rv = rv.Elem()
+	}
+	rv, err := enumFromName(rv, ft)
+	if err != nil {
+		return 0, err
+	}
+
+	if rv.Kind() == reflect.Bool {
+		if rv.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	var n uint64
+	switch {
+	case rv.CanUint():
+		n = rv.Uint()
+	case rv.CanInt() && rv.Int() >= 0:
+		n = uint64(rv.Int())
+	case rv.CanFloat() && rv.Float() >= 0 && rv.Float() == math.Trunc(rv.Float()):
+		// JSON numbers
+		n = uint64(rv.Float())
+	default:
+		return 0, &TypeError{ fmt.Sprintf("Can't pack %s as %v", valueType(rv), reflect.Kind(ft.Kind)) }
+	}
+
+	if ft.Bits < 64 && n >> ft.Bits != 0 {
+		return 0, &TypeError{ fmt.Sprintf("Value %d doesn't fit in %d bits", n, ft.Bits) }
+	}
+	return n, nil
+}
+
+func unpackValue(target interface{}, n uint64) error {
+	var val = reflect.ValueOf(target).Elem()
+	switch {
+	case val.Kind() == reflect.Bool:
+		val.SetBool(n != 0)
+	case val.CanUint():
+		val.SetUint(n)
+	default:
+		return &TypeError{ fmt.Sprintf("Can't unpack into %v", val.Type()) }
+	}
+	return nil
+}
+
+// A bitset accumulates or hands out packed values, low bits first.
+// Encoding writes a run of them straight into the output from start;
+// setting pos to 0 ends the run.
+type bitset struct {
+	bytes []byte
+	start int
+	pos uint
+}
+
+func (b *bitset) put(buf []byte, n uint64, width uint) []byte {
+	if b.pos == 0 {
+		b.start = len(buf)
+	}
+	for i := uint(0); i < width; i++ {
+		if b.pos % 8 == 0 {
+			buf = append(buf, 0)
+		}
+		if n >> i & 1 != 0 {
+			buf[b.start + int(b.pos / 8)] |= 1 << (b.pos % 8)
+		}
+		b.pos++
+	}
+	return buf
+}
+
+func (b *bitset) read(reader io.Reader, width uint) error {
+	b.bytes = make([]byte, (width + 7) / 8)
+	b.pos = 0
+	if _, err := io.ReadFull(reader, b.bytes); err != nil {
+		return readError("packed fields", err)
+	}
+	return nil
+}
+
+func (b *bitset) take(width uint) uint64 {
+	var n uint64
+	for i := uint(0); i < width; i++ {
+		if b.bytes[b.pos / 8] & (1 << (b.pos % 8)) != 0 {
+			n |= 1 << i
+		}
+		b.pos++
+	}
+	return n
+}
@@ -0,0 +1,109 @@
+package spack
+
+import (
+	"reflect"
+	"testing"
+)
+
+type packedFlags struct {
+	_ struct{} `spack:"packed"`
+	A bool
+	B bool
+	Level uint8 `spack:"bits=3"`
+	C bool
+	Name string
+	D bool
+	Count uint16 `spack:"bits=12"`
+}
+
+func TestPackedStruct(test *testing.T) {
+	var ft = MakeTypeSpec(packedFlags{})
+
+	var st = packedFlags{ A: true, Level: 5, C: true, Name: "x", D: true, Count: 4000 }
+	enc, err := EncodeToBytes(&st, ft)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	// A, B, Level, C in one byte; the name; D and Count in two bytes
+	var want = []byte{ 0x01 | 0x05 << 2 | 0x01 << 5, 1, 'x', 0x01 | (4000 & 0x7f) << 1, 4000 >> 7 }
+	if !reflect.DeepEqual(enc, want) {
+		test.Errorf("Wrong packing: %08b != %08b", enc, want)
+	}
+
+	var dec packedFlags
+	err = DecodeFromBytes(&dec, ft, enc)
+	if err != nil || dec != st {
+		test.Errorf("Packed roundtrip failed: %v %#v", err, dec)
+	}
+
+	var decMap = make(map[string]interface{})
+	err = DecodeFromBytes(&decMap, ft, enc)
+	if err != nil || decMap["Level"] != uint8(5) || decMap["D"] != true || decMap["Count"] != uint16(4000) {
+		test.Errorf("Packed map decode failed: %v %v", err, decMap)
+	}
+
+	enc2, err := EncodeToBytes(&decMap, ft)
+	if err != nil || !reflect.DeepEqual(enc2, enc) {
+		test.Errorf("Packed map encode failed: %v %v", err, enc2)
+	}
+
+	st.Level = 8
+	_, err = EncodeToBytes(&st, ft)
+	if err == nil {
+		test.Errorf("Overflowing bit width allowed")
+	}
+}
+
+func TestPackedSpecs(test *testing.T) {
+	type Loose struct {
+		A bool
+		B bool
+	}
+
+	ft, err := MakeTypeSpecWithOptions(Loose{}, SpecOptions{ PackStructs: true })
+	if err != nil {
+		test.Fatalf("Spec error: %v", err)
+	}
+	enc, _ := EncodeToBytes(&Loose{ true, true }, ft)
+	if len(enc) != 1 {
+		test.Errorf("PackStructs didn't pack: %v", enc)
+	}
+
+	type Unpacked struct {
+		Level uint8 `spack:"bits=3"`
+	}
+	type TooWide struct {
+		_ struct{} `spack:"packed"`
+		Level uint8 `spack:"bits=9"`
+	}
+	type Signed struct {
+		_ struct{} `spack:"packed"`
+		Level int8 `spack:"bits=3"`
+	}
+
+	for _, bad := range []interface{}{ Unpacked{}, TooWide{}, Signed{} } {
+		if _, err := MakeTypeSpecWithOptions(bad, SpecOptions{}); err == nil {
+			test.Errorf("Bad bit width allowed: %T", bad)
+		}
+	}
+
+	// Packing works alongside presence bitmaps; absent fields don't
+	// break runs
+	type Both struct {
+		_ struct{} `spack:"sparse,packed"`
+		A bool
+		N uint8 `spack:"bits=4"`
+		S string
+		B bool
+	}
+	var both = MakeTypeSpec(Both{})
+	enc, err = EncodeToBytes(&Both{ N: 9, B: true }, both)
+	var dec Both
+	if err == nil {
+		err = DecodeFromBytes(&dec, both, enc)
+	}
+	if err != nil || dec != (Both{ N: 9, B: true }) || len(enc) != 2 {
+		test.Errorf("Sparse packed roundtrip failed: %v %v %#v", err, enc, dec)
+	}
+}
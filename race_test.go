@@ -0,0 +1,8 @@
+//go:build race
+
+package spack
+
+func init() {
+	// sync.Pool drops items at random under the race detector
+	raceEnabled = true
+}
@@ -0,0 +1,291 @@
+package spack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Store is the subset of a key-value store needed to persist type
+// records. Scan must call fn for every key with the given prefix.
+type Store interface {
+	Put(key []byte, value []byte) error
+	Scan(prefix []byte, fn func(key []byte, value []byte) error) error
+}
+
+var typeSetMagic = []byte("SPTS\x01")
+
+// A layoutChange lists the fields one version of _type added to one of
+// the structs it stores.
+type layoutChange struct {
+	exemplar interface{}
+	fields []string
+}
+
+// typeLayouts is how the stored layout of _type has grown, one entry
+// per version: records of a version lack the fields of later entries.
+// Version 0 is the original layout.
+var typeLayouts = []layoutChange{
+	layoutChange{ nil, nil },
+	layoutChange{ VersionedType{}, []string{ "Aliases", "Deleted" } },
+	layoutChange{ TypeSpec{}, []string{ "Skipped" } },
+	layoutChange{ fieldType{}, []string{ "Num" } },
+	layoutChange{ fieldType{}, []string{ "Flags" } },
+	layoutChange{ fieldType{}, []string{ "Default" } },
+	layoutChange{ fieldType{}, []string{ "Rules" } },
+	layoutChange{ fieldType{}, []string{ "Enum" } },
+	layoutChange{ fieldType{}, []string{ "Bits" } },
+	layoutChange{ TypeSpec{}, []string{ "TrackRefs" } },
+}
+
+// addTypeVersions registers every layout of _type. Older records decode
+// straight into VersionedType, leaving the fields they lack zero, so
+// the upgraders have nothing to do.
+func addTypeVersions(typeType *VersionedType) {
+	var keep = func(obj interface{}) (interface{}, error) {
+		return obj, nil
+	}
+
+	var latest = len(typeLayouts) - 1
+	var spec = MakeTypeSpec(VersionedType{})
+
+	for v := latest; v >= 0; v-- {
+		var upgrader UpgradeFunc
+		if v > 0 {
+			upgrader = keep
+		}
+		typeType.AddVersionObj(&Version{ Version: uint16(v), Spec: spec, Exemplar: VersionedType{}, Upgrader: upgrader })
+
+		if v > 0 {
+			spec = spec.withoutFields(typeLayouts[v].exemplar, typeLayouts[v].fields)
+		}
+	}
+}
+
+// withoutFields is the spec with some fields of one struct removed, to
+// describe an older layout.
+func (ts *TypeSpec) withoutFields(exemplar interface{}, labels []string) *TypeSpec {
+	var name = structName(reflect.TypeOf(exemplar))
+
+	var structs = make(structMap, len(ts.Structs))
+	for n, ft := range ts.Structs {
+		structs[n] = ft
+	}
+
+	var old = *ts.Structs[name]
+	old.Elem = nil
+	for _, fieldFt := range ts.Structs[name].Elem {
+		if !containsString(labels, fieldFt.Label) {
+			old.Elem = append(old.Elem, fieldFt)
+		}
+	}
+	structs[name] = &old
+
+	return &TypeSpec{ Structs: structs, Top: ts.Top, Skipped: ts.Skipped, TrackRefs: ts.TrackRefs }
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Type records are keyed by tag rather than name, since the tag is the
+// type's permanent identity.
+func typeRecordKey(tag uint16) string {
+	return fmt.Sprintf("%05d", tag)
+}
+
+func (ts *TypeSet) sortedTypes() []*VersionedType {
+	var types = make([]*VersionedType, 0, len(ts.Types))
+	for _, vt := range ts.Types {
+		types = append(types, vt)
+	}
+	sortByTag(types)
+	return types
+}
+
+// storedTypes is sortedTypes plus tombstones.
+func (ts *TypeSet) storedTypes() []*VersionedType {
+	var types = make([]*VersionedType, 0, len(ts.Types) + len(ts.Tombstones))
+	for _, vt := range ts.Types {
+		types = append(types, vt)
+	}
+	for _, vt := range ts.Tombstones {
+		types = append(types, vt)
+	}
+	sortByTag(types)
+	return types
+}
+
+func sortByTag(types []*VersionedType) {
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Tag < types[j].Tag
+	})
+}
+
+// SyncToStore writes a _type record for every Dirty type and clears
+// the Dirty flags.
+func (ts *TypeSet) SyncToStore(store Store) error {
+	var typeType, err = ts.LookupType("_type")
+	if err != nil {
+		return err
+	}
+
+	for _, vt := range ts.storedTypes() {
+		if !vt.Dirty {
+			continue
+		}
+
+		enc, err := typeType.EncodeObj(vt)
+		if err != nil {
+			return err
+		}
+
+		err = store.Put(typeType.EncodeKey(typeRecordKey(vt.Tag)), enc)
+		if err != nil {
+			return err
+		}
+
+		vt.Dirty = false
+		vt.Persisted = true
+	}
+
+	return nil
+}
+
+// LoadFromStore loads every stored _type record into the set. Types
+// already registered are reconciled with their stored tags, see
+// LoadType.
+func (ts *TypeSet) LoadFromStore(store Store) error {
+	var typeType, err = ts.LookupType("_type")
+	if err != nil {
+		return err
+	}
+
+	return store.Scan(typeType.EncodeTag(), func(key []byte, value []byte) error {
+		return ts.loadRecord(typeType, value)
+	})
+}
+
+func (ts *TypeSet) loadRecord(typeType *VersionedType, enc []byte) error {
+	obj, _, err := typeType.DecodeObj(enc, false)
+	if err != nil {
+		return err
+	}
+
+	var vt, ok = obj.(*VersionedType)
+	if !ok {
+		return &TypeError{ fmt.Sprintf("Type record decoded as %T", obj) }
+	}
+
+	// Always registered by NewTypeSet
+	if vt.Name == "_type" {
+		return nil
+	}
+
+	return ts.LoadType(vt)
+}
+
+// Save writes the whole set, including LastTag so that tags of types
+// no longer present are never handed out again.
+func (ts *TypeSet) Save(w io.Writer) error {
+	var typeType, err = ts.LookupType("_type")
+	if err != nil {
+		return err
+	}
+	var writer = bufio.NewWriter(w)
+
+	writer.Write(typeSetMagic)
+	writeLength(int(ts.LastTag), writer)
+
+	var types = ts.storedTypes()
+	writeLength(len(types), writer)
+
+	for _, vt := range types {
+		enc, err := typeType.EncodeObj(vt)
+		if err != nil {
+			return err
+		}
+		writeLength(len(enc), writer)
+		writer.Write(enc)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, vt := range types {
+		vt.Persisted = true
+	}
+	return nil
+}
+
+// LoadTypeSet reads a set written by Save. Exemplars and upgraders are
+// attached afterwards by calling AddVersion as usual.
+func LoadTypeSet(r io.Reader) (*TypeSet, error) {
+	var reader = bufio.NewReader(r)
+
+	var magic = make([]byte, len(typeSetMagic))
+	_, err := io.ReadFull(reader, magic)
+	if err != nil || !bytes.Equal(magic, typeSetMagic) {
+		return nil, &TypeError{ "Not a saved type set" }
+	}
+
+	lastTag, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, &TypeError{ fmt.Sprintf("Couldn't read last tag: %v", err) }
+	}
+
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, &TypeError{ fmt.Sprintf("Couldn't read type count: %v", err) }
+	}
+
+	var ts = NewTypeSet()
+	var typeType = ts.Type("_type")
+
+	for i := uint64(0); i < count; i++ {
+		encLen, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, &TypeError{ fmt.Sprintf("Couldn't read type record length: %v", err) }
+		}
+
+		if encLen > math.MaxInt32 {
+			return nil, &TypeError{ fmt.Sprintf("Type record too long: %d", encLen) }
+		}
+
+		// Read as it arrives rather than trusting the length
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, reader, int64(encLen))
+		if err != nil {
+			return nil, &TypeError{ fmt.Sprintf("Couldn't read type record: %v", err) }
+		}
+		var enc = buf.Bytes()
+
+		err = ts.loadRecord(typeType, enc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if uint16(lastTag) > ts.LastTag {
+		ts.LastTag = uint16(lastTag)
+	}
+
+	// Freshly loaded, so nothing is dirty yet
+	for _, vt := range ts.storedTypes() {
+		vt.Dirty = false
+	}
+
+	return ts, nil
+}
@@ -0,0 +1,426 @@
+package spack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type memStore struct {
+	data map[string][]byte
+	puts int
+}
+
+func newMemStore() *memStore {
+	return &memStore{ data: make(map[string][]byte) }
+}
+
+func (ms *memStore) Put(key []byte, value []byte) error {
+	ms.data[string(key)] = append([]byte(nil), value...)
+	ms.puts++
+	return nil
+}
+
+func (ms *memStore) Scan(prefix []byte, fn func(key []byte, value []byte) error) error {
+	var keys = make([]string, 0, len(ms.data))
+	for key := range ms.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var err = fn([]byte(key), ms.data[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type _test_registry_user struct {
+	Name string
+	Age uint16
+}
+
+func TestSyncToStore(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+	vt.AddVersion(0, _test_registry_user{}, nil)
+	ts.RegisterType("other").AddVersion(0, "", nil)
+
+	var store = newMemStore()
+	var err = ts.SyncToStore(store)
+	if err != nil {
+		test.Fatalf("Sync error: %v", err)
+	}
+
+	if store.puts != 3 || vt.Dirty {
+		test.Errorf("Wrong initial sync: %d puts", store.puts)
+	}
+
+	ts.SyncToStore(store)
+	if store.puts != 3 {
+		test.Errorf("Clean types re-synced: %d puts", store.puts)
+	}
+
+	vt.AddVersion(1, "", nil)
+	ts.SyncToStore(store)
+	if store.puts != 4 {
+		test.Errorf("Dirty type not synced: %d puts", store.puts)
+	}
+
+	var loaded = NewTypeSet()
+	err = loaded.LoadFromStore(store)
+	if err != nil {
+		test.Fatalf("Load error: %v", err)
+	}
+
+	var lvt = loaded.Type("user")
+	if lvt.Tag != vt.Tag || len(lvt.Versions) != 2 || lvt.Dirty {
+		test.Errorf("Wrong loaded type: %#v", lvt)
+	}
+
+	err = lvt.AddVersion(0, _test_registry_user{}, nil)
+	if err != nil {
+		test.Errorf("Couldn't attach exemplar to loaded type: %v", err)
+	}
+
+	var fresh = loaded.RegisterType("fresh")
+	if fresh.Tag != loaded.LastTag || fresh.Tag <= vt.Tag {
+		test.Errorf("Reused tag: %d", fresh.Tag)
+	}
+}
+
+func TestSaveTypeSet(test *testing.T) {
+	var ts = NewTypeSet()
+	ts.RegisterType("user").AddVersion(0, _test_registry_user{}, nil)
+	ts.RegisterType("other").AddVersion(0, "", nil)
+
+	// Tags above any current type must stay reserved
+	ts.LastTag = 10
+
+	var buf bytes.Buffer
+	var err = ts.Save(&buf)
+	if err != nil {
+		test.Fatalf("Save error: %v", err)
+	}
+
+	loaded, err := LoadTypeSet(&buf)
+	if err != nil {
+		test.Fatalf("Load error: %v", err)
+	}
+
+	if len(loaded.Types) != 3 || loaded.LastTag != 10 {
+		test.Errorf("Wrong loaded set: %d types, last tag %d", len(loaded.Types), loaded.LastTag)
+	}
+
+	var vt = loaded.Type("user")
+	if vt.Tag != ts.Type("user").Tag || vt.Dirty {
+		test.Errorf("Wrong loaded type: %#v", vt)
+	}
+
+	if loaded.RegisterType("fresh").Tag != 11 {
+		test.Errorf("Reserved tag reused")
+	}
+
+	_, err = LoadTypeSet(strings.NewReader("nonsense"))
+	if err == nil {
+		test.Errorf("Loaded garbage type set")
+	}
+}
+
+func TestSchemaLock(test *testing.T) {
+	var ts = NewTypeSet()
+	ts.RegisterType("user").AddVersion(0, _test_registry_user{}, nil)
+
+	var lock bytes.Buffer
+	var err = ts.WriteLock(&lock)
+	if err != nil {
+		test.Fatalf("Lock write error: %v", err)
+	}
+
+	if !strings.Contains(lock.String(), "type \"user\" 2\n  version 0\n") ||
+		!strings.Contains(lock.String(), "\n      Age uint16\n") {
+		test.Errorf("Unexpected lock contents:\n%s", lock.String())
+	}
+
+	err = ts.CheckLock(bytes.NewReader(lock.Bytes()))
+	if err != nil {
+		test.Errorf("Lock check failed on unchanged set: %v", err)
+	}
+
+	var changed = NewTypeSet()
+	changed.RegisterType("user").AddVersion(0, "", nil)
+	changed.RegisterType("extra")
+
+	err = changed.CheckLock(bytes.NewReader(lock.Bytes()))
+	if err == nil {
+		test.Fatalf("Lock check passed on changed set")
+	}
+
+	var msg = err.Error()
+	if !strings.Contains(msg, "type user version 0: spec differs") ||
+		!strings.Contains(msg, "type extra: registered but not in lock") {
+		test.Errorf("Wrong lock error: %s", msg)
+	}
+}
+
+func TestSchemaLockTombstones(test *testing.T) {
+	var ts = NewTypeSet()
+	ts.RegisterType("user").AddVersion(0, _test_registry_user{}, nil)
+	ts.RegisterType("session")
+	ts.DeleteType("session")
+
+	var lock bytes.Buffer
+	ts.WriteLock(&lock)
+
+	// _type's layouts are the library's business
+	if strings.Contains(lock.String(), "_type") ||
+		!strings.Contains(lock.String(), "\ntombstone \"session\" 3\nlast tag 3\n") {
+		test.Errorf("Unexpected lock contents:\n%s", lock.String())
+	}
+	if err := ts.CheckLock(bytes.NewReader(lock.Bytes())); err != nil {
+		test.Errorf("Lock check failed on unchanged set: %v", err)
+	}
+
+	var undeleted = NewTypeSet()
+	undeleted.RegisterType("user").AddVersion(0, _test_registry_user{}, nil)
+
+	var err = undeleted.CheckLock(bytes.NewReader(lock.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "tombstone session 3: in lock but not registered") ||
+		!strings.Contains(err.Error(), "last tag: 3 in lock, 2 registered") {
+		test.Errorf("Wrong lock error: %v", err)
+	}
+}
+
+func TestMalformedLock(test *testing.T) {
+	for _, line := range []string{
+		"type \"user\"", "type \"\" 2", "type 2",
+		"tombstone \"session\"", "tombstone \"\" 3", "tombstone 3",
+	} {
+		var _, err = readLock(strings.NewReader(line + "\n"))
+		var typeErr *TypeError
+		if !errors.As(err, &typeErr) || !strings.Contains(typeErr.Message, "Bad ") {
+			test.Errorf("Wrong error for %q: %v", line, err)
+		}
+	}
+}
+
+func TestExplicitTags(test *testing.T) {
+	var ts = NewTypeSet()
+
+	var auto = ts.RegisterType("auto")
+	var autoTag = auto.Tag
+
+	vt, err := ts.RegisterTypeWithTag("fixed", autoTag)
+	if err != nil {
+		test.Fatalf("Couldn't take tag from unstored type: %v", err)
+	}
+
+	if vt.Tag != autoTag || auto.Tag == autoTag || ts.HasTag(0) {
+		test.Errorf("Wrong tags after pinning: %d, %d", vt.Tag, auto.Tag)
+	}
+
+	again, err := ts.RegisterTypeWithTag("fixed", autoTag)
+	if err != nil || again != vt {
+		test.Errorf("Re-registration with same tag failed: %v", err)
+	}
+
+	_, err = ts.RegisterTypeWithTag("fixed", 40)
+	if err == nil {
+		test.Errorf("Pinned type re-tagged")
+	}
+
+	_, err = ts.RegisterTypeWithTag("other", autoTag)
+	if err == nil {
+		test.Errorf("Pinned tag taken by another name")
+	}
+
+	_, err = ts.RegisterTypeWithTag("_type", 5)
+	if err == nil {
+		test.Errorf("_type re-tagged")
+	}
+}
+
+func TestTagReconciliation(test *testing.T) {
+	var ts = NewTypeSet()
+	ts.RegisterType("first").AddVersion(0, "", nil)
+	ts.RegisterType("second").AddVersion(0, _test_registry_user{}, nil)
+
+	var store = newMemStore()
+	ts.SyncToStore(store)
+
+	// Another binary registering in a different order
+	var other = NewTypeSet()
+	var second = other.RegisterType("second")
+	var fresh = other.RegisterType("fresh")
+	var first = other.RegisterType("first")
+	second.AddVersion(0, _test_registry_user{}, nil)
+	second.AddVersion(1, "", nil)
+	first.AddVersion(0, "", nil)
+
+	var err = other.LoadFromStore(store)
+	if err != nil {
+		test.Fatalf("Reconciliation failed: %v", err)
+	}
+
+	if first.Tag != ts.Type("first").Tag || second.Tag != ts.Type("second").Tag {
+		test.Errorf("Names not mapped to stored tags: %d, %d", first.Tag, second.Tag)
+	}
+
+	if fresh.Tag == first.Tag || fresh.Tag == second.Tag || fresh.Tag <= ts.LastTag {
+		test.Errorf("Fresh type not moved out of the way: %d", fresh.Tag)
+	}
+
+	if other.Type("second") != second || second.GetVersion(0).Exemplar == nil || !second.Dirty || first.Dirty {
+		test.Errorf("Registered type not merged: %#v", second)
+	}
+
+	// A pinned tag that disagrees with the store is a startup error
+	var pinned = NewTypeSet()
+	pinned.RegisterTypeWithTag("first", 30)
+	err = pinned.LoadFromStore(store)
+	if err == nil {
+		test.Errorf("Conflicting pinned tag accepted")
+	}
+
+	// As is a registered spec that disagrees with the stored one
+	var mismatched = NewTypeSet()
+	mismatched.RegisterType("first").AddVersion(0, uint32(0), nil)
+	err = mismatched.LoadFromStore(store)
+	if err == nil {
+		test.Errorf("Conflicting registered spec accepted")
+	}
+}
+
+func TestStoredRenameAndDelete(test *testing.T) {
+	var ts = NewTypeSet()
+	ts.RegisterType("user").AddVersion(0, "", nil)
+	ts.RegisterType("gone").AddVersion(0, "", nil)
+	var goneTag = ts.Type("gone").Tag
+
+	var store = newMemStore()
+	ts.SyncToStore(store)
+
+	ts.RenameType("user", "account")
+	ts.DeleteType("gone")
+	ts.SyncToStore(store)
+
+	// Code not yet updated for the rename
+	var loaded = NewTypeSet()
+	var old = loaded.RegisterType("user")
+	old.AddVersion(0, "", nil)
+
+	var err = loaded.LoadFromStore(store)
+	if err != nil {
+		test.Fatalf("Load failed: %v", err)
+	}
+
+	var account = loaded.Type("account")
+	if account != old || account.Tag != ts.Type("account").Tag || loaded.Type("user") != account {
+		test.Errorf("Renamed type not reconciled: %#v", account)
+	}
+
+	if loaded.Tombstones[goneTag] == nil || loaded.RegisterType("gone").Tag == goneTag {
+		test.Errorf("Tombstone not restored")
+	}
+
+	var buf bytes.Buffer
+	loaded.Save(&buf)
+	reloaded, err := LoadTypeSet(&buf)
+	if err != nil {
+		test.Fatalf("Reload failed: %v", err)
+	}
+
+	if reloaded.Tombstones[goneTag] == nil || reloaded.Type("user").Name != "account" {
+		test.Errorf("Rename or tombstone lost in save")
+	}
+}
+
+type baseAddress struct {
+	Street string
+	Zip uint32
+}
+
+type baseUser struct {
+	Name string
+	Age int16
+	Home *baseAddress
+	Others []baseAddress
+	Scores map[string]float64
+}
+
+// The _type record of a type "user" with version 0 baseUser, as written
+// by the original layout of _type.
+var baselineTypeRecord = "000004757365720002010100000102226769746875622e636f6d2f6272656e646f6e682f" +
+	"737061636b2f6261736555736572011905011800044e616d6500010400034167650001160101ff000025676974687562" +
+	"2e636f6d2f6272656e646f6e682f737061636b2f626173654164647265737304486f6d650001170101ff000025676974" +
+	"6875622e636f6d2f6272656e646f6e682f737061636b2f6261736541646472657373064f746865727300011502011800" +
+	"0000010e0000000653636f726573000000256769746875622e636f6d2f6272656e646f6e682f737061636b2f62617365" +
+	"416464726573730119020118000653747265657400010a00035a697000000001ff0000226769746875622e636f6d2f62" +
+	"72656e646f6e682f737061636b2f6261736555736572"
+
+func TestBaselineTypeRecord(test *testing.T) {
+	var enc, _ = hex.DecodeString(baselineTypeRecord)
+
+	var store = newMemStore()
+	var ts = NewTypeSet()
+	store.Put(ts.Type("_type").EncodeKey(typeRecordKey(2)), enc)
+
+	var err = ts.LoadFromStore(store)
+	if err != nil {
+		test.Fatalf("Loading baseline record: %v", err)
+	}
+
+	var vt = ts.Types["user"]
+	if vt == nil || vt.Tag != 2 || len(vt.Versions) != 1 || vt.Aliases != nil || vt.Deleted {
+		test.Fatalf("Wrong baseline type: %#v", vt)
+	}
+	if diffs := DiffSpecs(vt.Versions[0].Spec, MakeTypeSpec(baseUser{})); len(diffs) > 0 {
+		test.Errorf("Baseline spec differs: %v", diffs)
+	}
+	if err = vt.AddVersion(0, baseUser{}, nil); err != nil {
+		test.Errorf("Exemplar doesn't match baseline spec: %v", err)
+	}
+}
+
+func TestTypeLayouts(test *testing.T) {
+	var ts = NewTypeSet()
+	var typeType = ts.Type("_type")
+	if len(typeType.Versions) != len(typeLayouts) {
+		test.Fatalf("Wrong _type versions: %d", len(typeType.Versions))
+	}
+
+	var vt = ts.RegisterType("user")
+	vt.AddVersion(0, baseUser{}, nil)
+
+	// Map mode, since older layouts drop fields Go structs would refuse
+	var obj = make(map[string]interface{})
+	var err = DecodeFromBytes(&obj, typeType.Versions[0].Spec, mustEncode(test, typeType.Versions[0].Spec, vt))
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+
+	// Every layout still decodes, to the latest
+	for _, v := range typeType.Versions {
+		var enc, err = EncodeToBytes(obj, v.Spec)
+		if err != nil {
+			test.Fatalf("Encoding version %d: %v", v.Version, err)
+		}
+		enc = append([]byte{ byte(v.Version >> 8), byte(v.Version) }, enc...)
+
+		obj, _, err := typeType.DecodeObj(enc, false)
+		var dec, ok = obj.(*VersionedType)
+		if err != nil || !ok || dec.Name != "user" || dec.Tag != vt.Tag || len(dec.Versions) != 1 {
+			test.Errorf("Wrong decode of version %d: %v %#v", v.Version, err, obj)
+			continue
+		}
+		if diffs := DiffSpecs(dec.Versions[0].Spec, vt.Versions[0].Spec); len(diffs) > 0 {
+			test.Errorf("Version %d spec differs: %v", v.Version, diffs)
+		}
+	}
+}
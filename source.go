@@ -0,0 +1,224 @@
+package spack
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// GenerateSource emits Go type definitions for every version of vt,
+// named like UserV0, UserV1, with nested structs named after their
+// stored struct names (AddressV0, ...). It works from the stored specs,
+// so versions whose Go structs no longer exist are covered too. The
+// generated structs keep their stored names, so they can be attached
+// as exemplars.
+func (vt *VersionedType) GenerateSource(pkg string) ([]byte, error) {
+	var buf, body bytes.Buffer
+	var usesBig = false
+
+	for i := len(vt.Versions) - 1; i >= 0; i-- {
+		var v = vt.Versions[i]
+		var gen = newSourceGen(v.Spec, fmt.Sprintf("V%d", v.Version))
+		gen.writeVersion(&body, goIdent(vt.Name), v.Version)
+		usesBig = usesBig || gen.usesBig
+	}
+
+	fmt.Fprintf(&buf, "// Code generated by spack from the stored schema of %q. DO NOT EDIT.\n\n", vt.Name)
+	fmt.Fprintf(&buf, "package %s\n", pkg)
+	if usesBig {
+		fmt.Fprintf(&buf, "\nimport \"math/big\"\n")
+	}
+	buf.Write(body.Bytes())
+
+	var src, err = format.Source(buf.Bytes())
+	if err != nil {
+		return nil, &TypeError{ fmt.Sprintf("Generated invalid source: %v", err) }
+	}
+	return src, nil
+}
+
+type sourceGen struct {
+	spec *TypeSpec
+	suffix string
+	names map[string]string
+	used map[string]bool
+	usesBig bool
+}
+
+func newSourceGen(spec *TypeSpec, suffix string) *sourceGen {
+	return &sourceGen{
+		spec: spec,
+		suffix: suffix,
+		names: make(map[string]string),
+		used: make(map[string]bool),
+	}
+}
+
+func (g *sourceGen) writeVersion(buf *bytes.Buffer, typeName string, version uint16) {
+	var topName = g.claim(typeName + g.suffix)
+
+	var top = g.spec.Top
+	if reflect.Kind(top.Kind) == STRUCT_REFERENCE {
+		g.names[top.StructName] = topName
+	}
+
+	var structNames = make([]string, 0, len(g.spec.Structs))
+	for name := range g.spec.Structs {
+		structNames = append(structNames, name)
+	}
+	sort.Strings(structNames)
+
+	for _, name := range structNames {
+		if _, ok := g.names[name]; !ok {
+			g.names[name] = g.claim(goIdent(shortStructName(name)) + g.suffix)
+		}
+	}
+
+	fmt.Fprintf(buf, "\n// %s is version %d of %s.\n", topName, version, typeName)
+
+	if reflect.Kind(top.Kind) == STRUCT_REFERENCE {
+		g.writeStruct(buf, topName, top.StructName)
+	} else {
+		fmt.Fprintf(buf, "type %s %s\n", topName, g.typeExpr(top))
+	}
+
+	for _, name := range structNames {
+		if g.names[name] == topName {
+			continue
+		}
+		fmt.Fprintf(buf, "\n// %s was stored as %s.\n", g.names[name], name)
+		g.writeStruct(buf, g.names[name], name)
+	}
+}
+
+func (g *sourceGen) writeStruct(buf *bytes.Buffer, goName string, structName string) {
+	fmt.Fprintf(buf, "type %s struct {\n", goName)
+	var structFt = g.spec.Structs[structName]
+	var structOpts []string
+	if structFt.Flags & FLAG_SPARSE != 0 {
+		structOpts = append(structOpts, "sparse")
+	}
+	if structFt.Flags & FLAG_PACKED != 0 {
+		structOpts = append(structOpts, "packed")
+	}
+	structOpts = append(structOpts, "name=" + structName)
+	fmt.Fprintf(buf, "\t_ struct{} %s\n", tagLiteral("spack:" + strconv.Quote(joinTagOptions(structOpts))))
+	for _, fieldFt := range structFt.Elem {
+		var typ = g.typeExpr(fieldFt)
+		var opts []string
+		if exportedName(fieldFt.Label) != fieldFt.Label {
+			opts = append(opts, "label=" + fieldFt.Label)
+		}
+		if fieldFt.Num != 0 {
+			opts = append(opts, fmt.Sprintf("n=%d", fieldFt.Num))
+		}
+		if fieldFt.Flags & FLAG_OPTIONAL != 0 {
+			opts = append(opts, "optional")
+		}
+		if fieldFt.Bits != 0 {
+			opts = append(opts, fmt.Sprintf("bits=%d", fieldFt.Bits))
+		}
+		if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			opts = append(opts, "ignore")
+		}
+		var comment string
+		opts = append(opts, fieldFt.Rules...)
+		if text, ok := defaultTagText(fieldFt); ok {
+			opts = append(opts, "default=" + text)
+		} else if fieldFt.Default != nil {
+			comment = " // default must be registered"
+		}
+		if fieldFt.Enum != nil {
+			comment += " // " + fieldTypeText(fieldFt)
+		}
+		if len(opts) > 0 {
+			var tag = "spack:" + strconv.Quote(joinTagOptions(opts))
+			fmt.Fprintf(buf, "\t%s %s %s%s\n", exportedName(fieldFt.Label), typ, tagLiteral(tag), comment)
+			continue
+		}
+		fmt.Fprintf(buf, "\t%s %s%s\n", exportedName(fieldFt.Label), typ, comment)
+	}
+	fmt.Fprintf(buf, "}\n")
+}
+
+// tagLiteral writes a struct tag as a raw string where it can be one.
+func tagLiteral(tag string) string {
+	if strconv.CanBackquote(tag) {
+		return "`" + tag + "`"
+	}
+	return strconv.Quote(tag)
+}
+
+func (g *sourceGen) typeExpr(ft *fieldType) string {
+	var kind = reflect.Kind(ft.Kind)
+
+	if typ, ok := kindTypes[kind]; ok {
+		return typ.String()
+	}
+	if typ, ok := bigTypes[kind]; ok {
+		g.usesBig = true
+		return "*" + typ.String()
+	}
+
+	switch kind {
+	case reflect.Slice:
+		return "[]" + g.typeExpr(ft.Elem[0])
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", g.typeExpr(ft.Elem[0]), g.typeExpr(ft.Elem[1]))
+	case reflect.Ptr:
+		return "*" + g.typeExpr(ft.Elem[0])
+	case IGNORED_FIELD:
+		return "struct{}"
+	case STRUCT_REFERENCE:
+		return g.names[ft.StructName]
+	}
+
+	return fmt.Sprintf("interface{} /* unknown kind %d */", ft.Kind)
+}
+
+func (g *sourceGen) claim(name string) string {
+	var out = name
+	for i := 2; g.used[out]; i++ {
+		out = fmt.Sprintf("%s_%d", name, i)
+	}
+	g.used[out] = true
+	return out
+}
+
+func shortStructName(name string) string {
+	var idx = strings.LastIndex(name, "/")
+	if idx >= 0 {
+		name = name[idx+1:]
+	}
+	if name == "" {
+		return "Anon"
+	}
+	return name
+}
+
+// goIdent turns an arbitrary name into an exported Go identifier,
+// e.g. "user_profile" -> "UserProfile".
+func goIdent(name string) string {
+	var out []rune
+	var upper = true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		out = append(out, r)
+	}
+	if len(out) == 0 || unicode.IsDigit(out[0]) {
+		out = append([]rune("T"), out...)
+	}
+	return string(out)
+}
@@ -0,0 +1,102 @@
+package spack
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGenerateSource(test *testing.T) {
+	type Address struct {
+		Street string
+		Zip uint32
+	}
+
+	type st0 struct {
+		Name string
+		Home *Address
+	}
+
+	type st1 struct {
+		Name string
+		Homes []Address
+		Scores map[string][]float64
+		Skip bool `spack:"ignore"`
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user_profile")
+	vt.AddVersion(0, st0{}, nil)
+	vt.AddVersion(1, st1{}, nil)
+	vt.AddVersion(2, "just a string", nil)
+
+	src, err := vt.GenerateSource("history")
+	if err != nil {
+		test.Fatalf("Generate error: %v", err)
+	}
+
+	var text = string(src)
+
+	_, err = parser.ParseFile(token.NewFileSet(), "gen.go", src, 0)
+	if err != nil {
+		test.Fatalf("Generated source doesn't parse: %v\n%s", err, text)
+	}
+
+	for _, want := range []string{
+		"package history",
+		"type UserProfileV0 struct",
+		"_    struct{} `spack:\"name=" + reflect.TypeOf(st0{}).PkgPath() + "/st0\"`",
+		"Home *AddressV0",
+		"type AddressV0 struct",
+		"Homes  []AddressV1",
+		"Scores map[string][]float64",
+		"Skip   struct{} `spack:\"ignore\"`",
+		"type UserProfileV2 string",
+	} {
+		if !strings.Contains(text, want) {
+			test.Errorf("Generated source missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestGenerateSourceAnonymous(test *testing.T) {
+	type st0 struct {
+		Owner struct {
+			Name string `spack:"maxlen=3"`
+		}
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("pet")
+	vt.AddVersion(0, st0{}, nil)
+
+	src, err := vt.GenerateSource("history")
+	if err != nil {
+		test.Fatalf("Generate error: %v", err)
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), "gen.go", src, 0)
+	if err != nil {
+		test.Fatalf("Generated source doesn't parse: %v\n%s", err, src)
+	}
+
+	// Struct names read back from the generated tags
+	var names = make(map[string]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		var field, ok = node.(*ast.Field)
+		if ok && field.Tag != nil && len(field.Names) == 1 && field.Names[0].Name == "_" {
+			var tag, _ = strconv.Unquote(field.Tag.Value)
+			names[parseTag(reflect.StructTag(tag))["name"]] = true
+		}
+		return true
+	})
+
+	var anon = structName(reflect.TypeOf(st0{}.Owner))
+	if !strings.Contains(anon, "maxlen=3") || !names[anon] {
+		test.Errorf("Anonymous struct name not kept: %q in %v\n%s", anon, names, src)
+	}
+}
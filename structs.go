@@ -0,0 +1,451 @@
+package spack
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// structName is the name a Go struct is recorded under in a spec. A
+// struct can fix its own name, independent of package path and Go type
+// name, with a blank field tagged `spack:"name=..."`.
+func structName(typ reflect.Type) string {
+	if name := structTag(typ)["name"]; name != "" {
+		return name
+	}
+
+	// Anonymous structs are named by their shape, so distinct ones
+	// don't collide
+	if typ.Name() == "" {
+		return shapeName(typ)
+	}
+
+	return typ.PkgPath() + "/" + typ.Name()
+}
+
+// shapeName writes typ as Go would, but with named types qualified by
+// package path rather than package name, which isn't unique.
+func shapeName(typ reflect.Type) string {
+	if typ.Name() != "" {
+		if typ.PkgPath() == "" {
+			return typ.Name()
+		}
+		return typ.PkgPath() + "." + typ.Name()
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return "*" + shapeName(typ.Elem())
+	case reflect.Slice:
+		return "[]" + shapeName(typ.Elem())
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", typ.Len(), shapeName(typ.Elem()))
+	case reflect.Map:
+		return "map[" + shapeName(typ.Key()) + "]" + shapeName(typ.Elem())
+	case reflect.Struct:
+		if typ.NumField() == 0 {
+			return "struct {}"
+		}
+		var fields = make([]string, typ.NumField())
+		for i := range fields {
+			var field = typ.Field(i)
+			var text = shapeName(field.Type)
+			if !field.Anonymous {
+				text = field.Name + " " + text
+			}
+			if field.Tag != "" {
+				text += " " + strconv.Quote(string(field.Tag))
+			}
+			fields[i] = text
+		}
+		return "struct { " + strings.Join(fields, "; ") + " }"
+	}
+
+	// Kinds specs can't hold anyway
+	return typ.String()
+}
+
+func directFields(typ reflect.Type) []reflect.StructField {
+	var fields = make([]reflect.StructField, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		var field = typ.Field(i)
+		// Blank fields only carry struct-level tags
+		if field.Name != "_" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// flattenFields lists a struct's fields with those of embedded structs
+// promoted into it, as encoding/json does: a shallower field hides
+// deeper ones of the same name, and same-depth clashes hide each other.
+// The Index of each field is its full path from typ.
+func flattenFields(typ reflect.Type) []reflect.StructField {
+	type level struct {
+		typ reflect.Type
+		index []int
+	}
+
+	var byName = make(map[string][]reflect.StructField)
+	var depths = make(map[string]int)
+	var visited = make(map[reflect.Type]bool)
+	var current = []level{ level{ typ, nil } }
+
+	for depth := 0; len(current) > 0; depth++ {
+		var next []level
+
+		for _, lv := range current {
+			if visited[lv.typ] {
+				continue
+			}
+			visited[lv.typ] = true
+
+			for _, field := range directFields(lv.typ) {
+				field.Index = append(append([]int(nil), lv.index...), field.Index...)
+
+				if field.Anonymous && !parseTag(field.Tag).has("ignore") {
+					var ft = field.Type
+					var isPtr = ft.Kind() == reflect.Ptr
+					if isPtr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						// Can't allocate through unexported embedded pointers
+						if !(isPtr && field.PkgPath != "") {
+							next = append(next, level{ ft, field.Index })
+						}
+						continue
+					}
+				}
+
+				var seenDepth, seen = depths[field.Name]
+				if seen && seenDepth < depth {
+					continue
+				}
+				depths[field.Name] = depth
+				byName[field.Name] = append(byName[field.Name], field)
+			}
+		}
+
+		current = next
+	}
+
+	var fields = make([]reflect.StructField, 0, len(byName))
+	for _, clashing := range byName {
+		if len(clashing) == 1 {
+			fields = append(fields, clashing[0])
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		var a, b = fields[i].Index, fields[j].Index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	return fields
+}
+
+// fieldForRead follows an index path through embedded pointers; a nil
+// one yields the zero value of the field.
+func fieldForRead(val reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return reflect.Zero(val.Type().Elem().FieldByIndex(index[i:]).Type)
+			}
+			val = val.Elem()
+		}
+		val = val.Field(x)
+	}
+	return val
+}
+
+// fieldForWrite is fieldForRead, allocating nil embedded pointers.
+func fieldForWrite(val reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
+		val = val.Field(x)
+	}
+	return val
+}
+
+// -------------------------------
+
+// A structBinding maps each field of a stored struct spec to the Go
+// field holding it (an index path, nil if the Go struct lacks it).
+// Fields are matched by label, so a struct whose name doesn't match the
+// stored one can still be used if its shape is compatible.
+type structBinding struct {
+	fields [][]int
+	defaults []boundDefault
+	// Exported Go fields the spec has no place for, which encoding
+	// would lose
+	unbound []string
+}
+
+// A boundDefault fills a Go field the stored spec lacks with its tag
+// default, encoded in a spec of its own type.
+type boundDefault struct {
+	index []int
+	spec *TypeSpec
+	enc []byte
+}
+
+type bindingKey struct {
+	typ reflect.Type
+	ft *fieldType
+}
+
+// bindStruct binds a Go struct to one of the spec's structs. Bindings
+// are kept on the spec, so they go when it does.
+func bindStruct(typ reflect.Type, name string, ts *TypeSpec) (*structBinding, error) {
+	var structFt = ts.Structs[name]
+	if structFt == nil {
+		return nil, &TypeError{ fmt.Sprintf("No such struct in spec: %s", name) }
+	}
+
+	if b, ok := ts.bindingCache().Load(bindingKey{ typ, structFt }); ok {
+		return b.(*structBinding), nil
+	}
+
+	var b, err = (&binder{ ts, make(map[bindingKey]bool) }).bind(typ, name)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (ts *TypeSpec) bindingCache() *sync.Map {
+	if cache, ok := ts.bindings.Load().(*sync.Map); ok {
+		return cache
+	}
+	ts.bindings.CompareAndSwap(nil, new(sync.Map))
+	return ts.bindings.Load().(*sync.Map)
+}
+
+type binder struct {
+	spec *TypeSpec
+	seen map[bindingKey]bool
+}
+
+func (bd *binder) bind(typ reflect.Type, name string) (*structBinding, error) {
+	var structFt = bd.spec.Structs[name]
+	if structFt == nil {
+		return nil, &TypeError{ fmt.Sprintf("No such struct in spec: %s", name) }
+	}
+
+	var key = bindingKey{ typ, structFt }
+	if b, ok := bd.spec.bindingCache().Load(key); ok {
+		return b.(*structBinding), nil
+	}
+
+	// Recursive structs: assume compatible while checking the rest
+	if bd.seen[key] {
+		return nil, nil
+	}
+	bd.seen[key] = true
+
+	var b = &structBinding{ make([][]int, len(structFt.Elem)), nil, nil }
+	var numbered = numberedFields(typ)
+	var labelled = labelledFields(typ)
+	var allowMissing = structTag(typ).has("allow_missing")
+
+	for i, fieldFt := range structFt.Elem {
+		if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			continue
+		}
+
+		var field, ok = numbered[fieldFt.Num]
+		if fieldFt.Num == 0 || !ok {
+			field, ok = labelled[fieldFt.Label]
+			if !ok {
+				field, ok = typ.FieldByName(fieldFt.Label)
+				// A field stored under another label doesn't bind by name
+				ok = ok && fieldLabel(field) == fieldFt.Label
+			}
+			// The label may now name a field with a different number
+			if num, _ := parseTag(field.Tag).num(); ok && num != 0 && num != fieldFt.Num {
+				ok = false
+			}
+		}
+
+		if !ok {
+			if allowMissing {
+				continue
+			}
+			return nil, &TypeError{ fmt.Sprintf(
+				"Struct %s has no field for %s.%s (tag it spack:\"allow_missing\" to drop stored fields)",
+				structName(typ), shortStructName(name), fieldFt.Label) }
+		}
+
+		if field.PkgPath != "" {
+			return nil, &TypeError{ fmt.Sprintf("Field %s of %s is unexported", field.Name, typ) }
+		}
+
+		var err = bd.compatible(field.Type, fieldFt)
+		if err != nil {
+			return nil, &TypeError{ fmt.Sprintf("Incompatible structs: %s, %s (field %s: %v)",
+					structName(typ), name, fieldFt.Label, err) }
+		}
+
+		b.fields[i] = field.Index
+	}
+
+	b.findUnbound(typ, structFt)
+
+	var err = b.bindDefaults(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	bd.spec.bindingCache().Store(key, b)
+	return b, nil
+}
+
+func (b *structBinding) bindDefaults(typ reflect.Type) error {
+	for _, field := range reflect.VisibleFields(typ) {
+		var tag = parseTag(field.Tag)
+		if !tag.has("default") || tag.has("ignore") || field.Anonymous || field.PkgPath != "" || b.covers(field.Index) {
+			continue
+		}
+
+		var value, err = defaultValue(tag["default"], field.Type)
+		if err != nil {
+			return &TypeError{ fmt.Sprintf("Bad default on %s.%s: %v", typ, field.Name, err) }
+		}
+
+		spec, err := MakeTypeSpecWithOptions(reflect.Zero(field.Type).Interface(), SpecOptions{})
+		if err != nil {
+			return err
+		}
+		enc, err := EncodeToBytes(value.Interface(), spec)
+		if err != nil {
+			return err
+		}
+
+		b.defaults = append(b.defaults, boundDefault{ field.Index, spec, enc })
+	}
+	return nil
+}
+
+// covers checks whether a Go field is, or is inside, a bound field.
+// findUnbound lists the exported fields of typ that no stored field
+// binds to, other than ones ignored by tag or skipped by policy.
+// Embedded structs count as bound if any field inside them is.
+func (b *structBinding) findUnbound(typ reflect.Type, structFt *fieldType) {
+	var ignored = make(map[string]bool)
+	for _, fieldFt := range structFt.Elem {
+		if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			ignored[fieldFt.Label] = true
+		}
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		var field = typ.Field(i)
+		if field.Name == "_" || field.PkgPath != "" || ignored[fieldLabel(field)] || parseTag(field.Tag).has("ignore") {
+			continue
+		}
+		var bound = false
+		for _, index := range b.fields {
+			bound = bound || len(index) > 0 && index[0] == i
+		}
+		if !bound {
+			b.unbound = append(b.unbound, field.Name)
+		}
+	}
+}
+
+func (b *structBinding) covers(index []int) bool {
+	for _, bound := range b.fields {
+		if bound != nil && len(bound) <= len(index) && reflect.DeepEqual(bound, index[:len(bound)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// numberedFields finds the fields of typ, including promoted ones,
+// tagged with a field number. Shallower fields win.
+func numberedFields(typ reflect.Type) map[uint16]reflect.StructField {
+	var out = make(map[uint16]reflect.StructField)
+	for _, field := range reflect.VisibleFields(typ) {
+		var num, _ = parseTag(field.Tag).num()
+		if num == 0 {
+			continue
+		}
+		if prev, ok := out[num]; !ok || len(field.Index) < len(prev.Index) {
+			out[num] = field
+		}
+	}
+	return out
+}
+
+// labelledFields is numberedFields for fields tagged with a label.
+func labelledFields(typ reflect.Type) map[string]reflect.StructField {
+	var out = make(map[string]reflect.StructField)
+	for _, field := range reflect.VisibleFields(typ) {
+		var label, ok = parseTag(field.Tag)["label"]
+		if !ok || label == "" {
+			continue
+		}
+		if prev, ok := out[label]; !ok || len(field.Index) < len(prev.Index) {
+			out[label] = field
+		}
+	}
+	return out
+}
+
+func (bd *binder) compatible(typ reflect.Type, ft *fieldType) error {
+	var kind = reflect.Kind(ft.Kind)
+
+	switch kind {
+	case reflect.Slice, reflect.Ptr:
+		if typ.Kind() != kind {
+			return fmt.Errorf("%v is not a %v", typ, kind)
+		}
+		return bd.compatible(typ.Elem(), ft.Elem[0])
+
+	case reflect.Map:
+		if typ.Kind() != kind {
+			return fmt.Errorf("%v is not a map", typ)
+		}
+		var err = bd.compatible(typ.Key(), ft.Elem[0])
+		if err != nil {
+			return err
+		}
+		return bd.compatible(typ.Elem(), ft.Elem[1])
+
+	case STRUCT_REFERENCE:
+		if typ.Kind() != reflect.Struct {
+			return fmt.Errorf("%v is not a struct", typ)
+		}
+		var _, err = bd.bind(typ, ft.StructName)
+		return err
+	}
+
+	if isBigKind(kind) {
+		if bigKind, ok := bigKindOf(typ); !ok || bigKind != kind {
+			return fmt.Errorf("%v is not a %s", typ, kindName(ft.Kind))
+		}
+		return nil
+	}
+
+	if typ.Kind() != kind {
+		return fmt.Errorf("%v is not %v", typ, kind)
+	}
+	return nil
+}
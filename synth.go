@@ -0,0 +1,227 @@
+package spack
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Synthesize builds a Go type with the layout described by the spec, so
+// versions without an exemplar can still be decoded into typed values.
+// Field names are the stored labels (exported if necessary); renamed
+// fields carry the original label in a spack tag so they still bind,
+// and every field has a json tag with it. Recursive structs can't be built
+// with reflect.StructOf and return an error.
+func (ts *TypeSpec) Synthesize() (reflect.Type, error) {
+	var s = &synthesizer{
+		spec: ts,
+		built: make(map[string]reflect.Type),
+		building: make(map[string]bool),
+	}
+	return s.goType(ts.Top)
+}
+
+type synthesizer struct {
+	spec *TypeSpec
+	built map[string]reflect.Type
+	building map[string]bool
+}
+
+func (s *synthesizer) goType(ft *fieldType) (reflect.Type, error) {
+	var kind = reflect.Kind(ft.Kind)
+
+	if typ, ok := kindTypes[kind]; ok {
+		return typ, nil
+	}
+	if typ, ok := bigTypes[kind]; ok {
+		return reflect.PtrTo(typ), nil
+	}
+
+	switch kind {
+	case reflect.Slice:
+		elem, err := s.goType(ft.Elem[0])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+
+	case reflect.Map:
+		key, err := s.goType(ft.Elem[0])
+		if err != nil {
+			return nil, err
+		}
+		if !key.Comparable() {
+			return nil, &TypeError{ fmt.Sprintf("Map key type is not comparable: %v", key) }
+		}
+		val, err := s.goType(ft.Elem[1])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.MapOf(key, val), nil
+
+	case reflect.Ptr:
+		elem, err := s.goType(ft.Elem[0])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elem), nil
+
+	case IGNORED_FIELD:
+		return reflect.TypeOf(struct{}{}), nil
+
+	case STRUCT_REFERENCE:
+		return s.structType(ft.StructName)
+	}
+
+	return nil, &TypeError{ fmt.Sprintf("Can't synthesize type for kind %v", ft.Kind) }
+}
+
+func (s *synthesizer) structType(name string) (reflect.Type, error) {
+	if typ, ok := s.built[name]; ok {
+		return typ, nil
+	}
+
+	if s.building[name] {
+		return nil, &TypeError{ fmt.Sprintf("Can't synthesize recursive struct %s", name) }
+	}
+
+	var structFt, ok = s.spec.Structs[name]
+	if !ok || structFt == nil {
+		return nil, &TypeError{ fmt.Sprintf("No such struct in spec: %s", name) }
+	}
+
+	s.building[name] = true
+	defer delete(s.building, name)
+
+	var used = make(map[string]bool)
+	var fields = make([]reflect.StructField, 0, len(structFt.Elem))
+
+	for _, fieldFt := range structFt.Elem {
+		var goName = exportedName(fieldFt.Label)
+		for used[goName] {
+			goName += "_"
+		}
+		used[goName] = true
+
+		typ, err := s.goType(fieldFt)
+		if err != nil {
+			return nil, err
+		}
+
+		var tag = fmt.Sprintf(`json:"%s"`, fieldFt.Label)
+		var opts []string
+		if goName != fieldFt.Label {
+			opts = append(opts, "label=" + fieldFt.Label)
+		}
+		if fieldFt.Num != 0 {
+			opts = append(opts, fmt.Sprintf("n=%d", fieldFt.Num))
+		}
+		if fieldFt.Flags & FLAG_OPTIONAL != 0 {
+			opts = append(opts, "optional")
+		}
+		if fieldFt.Bits != 0 {
+			opts = append(opts, fmt.Sprintf("bits=%d", fieldFt.Bits))
+		}
+		if reflect.Kind(fieldFt.Kind) == IGNORED_FIELD {
+			tag = `json:"-"`
+			opts = append(opts, "ignore")
+		}
+		opts = append(opts, fieldFt.Rules...)
+		if text, ok := defaultTagText(fieldFt); ok {
+			opts = append(opts, "default=" + text)
+		}
+		if len(opts) > 0 {
+			tag += " spack:" + strconv.Quote(joinTagOptions(opts))
+		}
+
+		fields = append(fields, reflect.StructField{
+			Name: goName,
+			Type: typ,
+			Tag: reflect.StructTag(tag),
+		})
+	}
+
+	var structOpts []string
+	if structFt.Flags & FLAG_SPARSE != 0 {
+		structOpts = append(structOpts, "sparse")
+	}
+	if structFt.Flags & FLAG_PACKED != 0 {
+		structOpts = append(structOpts, "packed")
+	}
+	// Types built by StructOf are anonymous, so each carries the stored
+	// name. It also keeps same-shaped structs distinct types.
+	structOpts = append(structOpts, "name=" + name)
+
+	fields = append([]reflect.StructField{ reflect.StructField{
+		Name: "_",
+		PkgPath: reflect.TypeOf(synthesizer{}).PkgPath(),
+		Type: reflect.TypeOf(struct{}{}),
+		Tag: reflect.StructTag("spack:" + strconv.Quote(joinTagOptions(structOpts))),
+	} }, fields...)
+
+	var typ = reflect.StructOf(fields)
+	s.built[name] = typ
+	return typ, nil
+}
+
+func exportedName(label string) string {
+	var first, _ = utf8.DecodeRuneInString(label)
+	if unicode.IsUpper(first) {
+		return label
+	}
+	return "X" + label
+}
+
+// -------------------------------
+
+// Type returns the Go type this version decodes into: the exemplar's
+// type if there is one, otherwise one synthesized from the spec.
+func (v *Version) Type() (reflect.Type, error) {
+	if v.Exemplar != nil {
+		return reflect.TypeOf(v.Exemplar), nil
+	}
+
+	v.synthLock.Lock()
+	defer v.synthLock.Unlock()
+
+	if v.synthType == nil {
+		typ, err := v.Spec.Synthesize()
+		if err != nil {
+			return nil, err
+		}
+		v.synthType = typ
+	}
+
+	return v.synthType, nil
+}
+
+// DecodeTyped decodes an object as the version it was written with,
+// without upgrading, always producing a typed value (a pointer to the
+// version's Type).
+func (vt *VersionedType) DecodeTyped(encObj []byte) (obj interface{}, version uint16, err error) {
+	if len(encObj) < 2 {
+		return nil, 0, &TypeError{ "Encoded object too short" }
+	}
+
+	version = uint16(encObj[0]) << 8 | uint16(encObj[1])
+
+	var _, v = vt.getVersion(version)
+	if v == nil {
+		return nil, version, &TypeError{ fmt.Sprintf("Version not registered: %d", version) }
+	}
+
+	typ, err := v.Type()
+	if err != nil {
+		return nil, version, err
+	}
+
+	obj = reflect.New(typ).Interface()
+	err = DecodeFromBytes(obj, v.Spec, encObj[2:])
+	if err != nil {
+		return nil, version, withOffset(err, 2)
+	}
+
+	return obj, version, nil
+}
@@ -0,0 +1,224 @@
+package spack
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSynthesize(test *testing.T) {
+	type Address struct {
+		Street string
+		Zip uint32
+	}
+
+	type Person struct {
+		Name string
+		Home *Address
+		Others []Address
+		Scores map[string]float64
+		Skip string `spack:"ignore" json:"-"`
+	}
+
+	var orig = Person{
+		"Brendon",
+		&Address{ "Main St", 1234 },
+		[]Address{ Address{ "Side St", 5678 } },
+		map[string]float64{ "one": 1.5 },
+		"",
+	}
+
+	var spec = MakeTypeSpec(orig)
+
+	enc, err := EncodeToBytes(&orig, spec)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	typ, err := spec.Synthesize()
+	if err != nil {
+		test.Fatalf("Synthesize error: %v", err)
+	}
+
+	// Five fields and the blank one naming the struct
+	if typ.Kind() != reflect.Struct || typ.NumField() != 6 || structName(typ) != spec.Top.StructName {
+		test.Fatalf("Wrong synthesized type: %v", typ)
+	}
+
+	var dec = reflect.New(typ).Interface()
+	err = DecodeFromBytes(dec, spec, enc)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+
+	origJSON, _ := json.Marshal(orig)
+	decJSON, _ := json.Marshal(dec)
+	if string(origJSON) != string(decJSON) {
+		test.Errorf("Synthesized decode mismatch:\n%s\n%s", origJSON, decJSON)
+	}
+
+	// Synthesized types produce the same spec again
+	var respec = MakeTypeSpec(reflect.New(typ).Elem().Interface())
+	if !sameSpec(spec, respec) {
+		test.Errorf("Respec mismatch:\n%v\n%v", spec.Top, respec.Top)
+	}
+}
+
+func TestSynthesizeRecursive(test *testing.T) {
+	type Recursive struct {
+		Rec *Recursive
+	}
+
+	_, err := MakeTypeSpec(Recursive{}).Synthesize()
+	if err == nil {
+		test.Errorf("Expected error synthesizing recursive struct")
+	}
+}
+
+func TestDecodeTyped(test *testing.T) {
+	type st0 struct {
+		Name string
+		Age uint16
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("test")
+	vt.AddVersion(0, st0{}, nil)
+
+	enc, err := vt.EncodeObj(&st0{ "Brend", 32 })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	vt.GetVersion(0).Exemplar = nil
+
+	obj, version, err := vt.DecodeTyped(enc)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+
+	var val = reflect.ValueOf(obj).Elem()
+	if version != 0 || val.FieldByName("Name").String() != "Brend" ||
+		val.FieldByName("Age").Uint() != 32 {
+		test.Errorf("Wrong typed decode: %#v", obj)
+	}
+}
+
+func TestSynthesizeSparse(test *testing.T) {
+	type Sparse struct {
+		_ struct{} `spack:"sparse"`
+		A string
+		B uint32 `spack:"optional"`
+	}
+
+	var spec = MakeTypeSpec(Sparse{})
+	typ, err := spec.Synthesize()
+	if err != nil {
+		test.Fatalf("Synthesize error: %v", err)
+	}
+
+	var diffs = DiffSpecs(spec, MakeTypeSpec(reflect.New(typ).Elem().Interface()))
+	if len(diffs) != 0 {
+		test.Errorf("Synthesized sparse type differs: %v", diffs)
+	}
+}
+
+func TestSynthesizeLabels(test *testing.T) {
+	type Labelled struct {
+		Name string `spack:"label=name"`
+		Kind uint16 `spack:"label=type"`
+	}
+
+	var orig = Labelled{ "Brend", 7 }
+	var spec = MakeTypeSpec(orig)
+	enc, err := EncodeToBytes(&orig, spec)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	typ, err := spec.Synthesize()
+	if err != nil {
+		test.Fatalf("Synthesize error: %v", err)
+	}
+
+	var dec = reflect.New(typ)
+	err = DecodeFromBytes(dec.Interface(), spec, enc)
+	if err != nil {
+		test.Fatalf("Decoding error: %v", err)
+	}
+	if dec.Elem().FieldByName("Xname").String() != "Brend" || dec.Elem().FieldByName("Xtype").Uint() != 7 {
+		test.Errorf("Wrong synthesized decode: %#v", dec.Interface())
+	}
+
+	reenc, err := EncodeToBytes(dec.Interface(), spec)
+	if err != nil || string(reenc) != string(enc) {
+		test.Errorf("Synthesized roundtrip failed: %v\n%v\n%v", err, reenc, enc)
+	}
+
+	var diffs = DiffSpecs(spec, MakeTypeSpec(dec.Elem().Interface()))
+	if len(diffs) != 0 {
+		test.Errorf("Synthesized labelled type differs: %v", diffs)
+	}
+}
+
+func TestSynthesizeSameShape(test *testing.T) {
+	type Left struct {
+		Name string
+	}
+	type Right struct {
+		Name string
+	}
+	type Pair struct {
+		L Left
+		R Right
+	}
+
+	var spec = MakeTypeSpec(Pair{})
+	var typ, err = spec.Synthesize()
+	if err != nil {
+		test.Fatalf("Synthesize error: %v", err)
+	}
+
+	// Each keeps its own name, however often it's asked for
+	var left, right = typ.Field(1).Type, typ.Field(2).Type
+	var fields = spec.Structs[spec.Top.StructName].Elem
+	for i := 0; i < 20; i++ {
+		if structName(left) != fields[0].StructName || structName(right) != fields[1].StructName {
+			test.Fatalf("Wrong names: %s, %s", structName(left), structName(right))
+		}
+	}
+	if left == right {
+		test.Errorf("Same-shaped structs synthesized as one type")
+	}
+
+	var respec = MakeTypeSpec(reflect.New(typ).Elem().Interface())
+	if !sameSpec(spec, respec) {
+		test.Errorf("Respec mismatch:\n%v\n%v", spec.Top, respec.Top)
+	}
+}
+
+func TestVersionTypeConcurrent(test *testing.T) {
+	type Person struct {
+		Name string
+	}
+	var v = &Version{ Version: 0, Spec: MakeTypeSpec(Person{}) }
+
+	var types = make([]reflect.Type, 8)
+	var wg sync.WaitGroup
+	for i := range types {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			types[i], _ = v.Type()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, typ := range types {
+		if typ == nil || typ != types[0] {
+			test.Errorf("Different synthesized types: %v", types)
+			break
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package spack
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// spackTag holds the comma-separated options of a `spack:"..."` struct
+// tag; flags map to "", options like "name=x" to their value.
+type spackTag map[string]string
+
+// Options whose values may contain commas take the rest of the tag, so
+// they must come last, unless the value is quoted Go-style:
+//
+//   spack:"default=\"a,b\",regex=^[a-z,]+$"
+var greedyTagOptions = map[string]bool{
+	"name": true,
+	"default": true,
+	"regex": true,
+	"label": true,
+}
+
+// knownTagOptions is every option spack reads, so one swallowed by an
+// unquoted greedy option can be reported.
+var knownTagOptions = map[string]bool{
+	"name": true, "default": true, "regex": true, "label": true,
+	"n": true, "bits": true, "optional": true, "ignore": true,
+	"sparse": true, "packed": true, "allow_missing": true,
+	"min": true, "max": true, "maxlen": true, "nonempty": true, "oneof": true,
+}
+
+func parseTag(tag reflect.StructTag) spackTag {
+	var out, _ = readTag(tag)
+	return out
+}
+
+// readTag is parseTag, failing on badly quoted values and on options
+// swallowed by an unquoted greedy one before them.
+func readTag(tag reflect.StructTag) (spackTag, error) {
+	var out = make(spackTag)
+	var firstErr error
+
+	var raw = tag.Get("spack")
+	for raw != "" {
+		var opt, rest, _ = strings.Cut(raw, ",")
+
+		var key, val, hasVal = strings.Cut(strings.TrimSpace(opt), "=")
+		if greedyTagOptions[key] && hasVal {
+			var err error
+			val, rest, err = greedyValue(key, raw[strings.Index(raw, "=") + 1:])
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		out[key] = val
+		raw = rest
+	}
+
+	return out, firstErr
+}
+
+// greedyValue reads a greedy option's value from text, returning what
+// follows it.
+func greedyValue(key string, text string) (string, string, error) {
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, `"`) {
+		var quoted, err = strconv.QuotedPrefix(text)
+		if err != nil {
+			return text, "", fmt.Errorf("%s: bad quoted value %s", key, text)
+		}
+		var val, _ = strconv.Unquote(quoted)
+		var rest = strings.TrimSpace(text[len(quoted):])
+		if rest != "" && !strings.HasPrefix(rest, ",") {
+			return val, "", fmt.Errorf("%s: %s follows its quoted value", key, rest)
+		}
+		return val, strings.TrimPrefix(rest, ","), nil
+	}
+
+	for _, part := range strings.Split(text, ",")[1:] {
+		var other, _, _ = strings.Cut(strings.TrimSpace(part), "=")
+		if knownTagOptions[other] {
+			return text, "", fmt.Errorf("%s takes the rest of the tag, including %q (put it last or quote its value)", key, part)
+		}
+	}
+	return text, "", nil
+}
+
+// joinTagOptions writes options as readTag reads them, quoting greedy
+// values that aren't last or would be misread.
+func joinTagOptions(opts []string) string {
+	var out = make([]string, len(opts))
+	for i, opt := range opts {
+		var key, val, hasVal = strings.Cut(opt, "=")
+		var last = i == len(opts) - 1
+		if greedyTagOptions[key] && hasVal && (!last || strings.Contains(val, ",") || strings.HasPrefix(strings.TrimSpace(val), `"`)) {
+			opt = key + "=" + strconv.Quote(val)
+		}
+		out[i] = opt
+	}
+	return strings.Join(out, ",")
+}
+
+func (t spackTag) has(key string) bool {
+	var _, ok = t[key]
+	return ok
+}
+
+// num reads a field number from "n=...", 0 if there isn't one.
+func (t spackTag) num() (uint16, error) {
+	var raw, ok = t["n"]
+	if !ok {
+		return 0, nil
+	}
+	var n, err = strconv.ParseUint(raw, 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%q is not a number from 1 to 65535", raw)
+	}
+	return uint16(n), nil
+}
+
+// fieldLabel is the label a field is stored under: its "label=..."
+// option if it has one, otherwise its name.
+func fieldLabel(field reflect.StructField) string {
+	if label, ok := parseTag(field.Tag)["label"]; ok && label != "" {
+		return label
+	}
+	return field.Name
+}
+
+// structTag finds struct-level options, which live on a blank field:
+//
+//   type User struct {
+//       _ struct{} `spack:"name=billing.User"`
+//       ...
+//   }
+func structTag(typ reflect.Type) spackTag {
+	for i := 0; i < typ.NumField(); i++ {
+		var field = typ.Field(i)
+		if field.Name == "_" && field.Tag.Get("spack") != "" {
+			return parseTag(field.Tag)
+		}
+	}
+	return make(spackTag)
+}
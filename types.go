@@ -4,9 +4,10 @@ import (
 	"sort"
 	"fmt"
 	"bytes"
-	"bufio"
 	"encoding/binary"
 	"reflect"
+	"strings"
+	"sync"
 )
 
 const BUFFER_SIZE = 256
@@ -18,17 +19,32 @@ type Version struct {
 	Spec *TypeSpec
 	Exemplar interface{} `spack:"ignore"`
 	Upgrader UpgradeFunc `spack:"ignore"`
+	synthType reflect.Type `spack:"ignore"`
+	synthLock sync.Mutex `spack:"ignore"`
 }
 
 type VersionedType struct {
 	Name string
 	Tag uint16
 	Versions []*Version
+	Aliases []string
+	Deleted bool
 	Dirty bool `spack:"ignore"`
+	Pinned bool `spack:"ignore"`
+	Persisted bool `spack:"ignore"`
+	SpecOptions SpecOptions `spack:"ignore"`
+	// ValidateOnDecode checks decoded objects against the latest
+	// version's constraints, as EncodeObj always does.
+	ValidateOnDecode bool `spack:"ignore"`
+	// DecodeOptions limits DecodeObj and DecodeInto, for records from
+	// untrusted sources.
+	DecodeOptions DecodeOptions `spack:"ignore"`
 }
 
 type TypeSet struct {
 	Types map[string]*VersionedType
+	Aliases map[string]string
+	Tombstones map[uint16]*VersionedType
 	LastTag uint16
 }
 
@@ -54,17 +70,19 @@ func EncodeKey(tag uint16, key string) []byte {
 func NewTypeSet() *TypeSet {
 	var ts = &TypeSet{
 		Types: make(map[string]*VersionedType),
+		Aliases: make(map[string]string),
+		Tombstones: make(map[uint16]*VersionedType),
 		LastTag: 0,
 	}
 
-	var typeType = ts.RegisterType("_type")
-	typeType.AddVersion(0, VersionedType{}, nil)
+	var typeType, _ = ts.RegisterTypeWithTag("_type", 1)
+	addTypeVersions(typeType)
 
 	return ts
 }
 
 func (ts *TypeSet) RegisterType(name string) *VersionedType {
-	t, ok := ts.Types[name]
+	t, ok := ts.lookup(name)
 	if ok {
 		return t
 	}
@@ -82,49 +100,318 @@ func (ts *TypeSet) RegisterType(name string) *VersionedType {
 	return t
 }
 
-func (ts *TypeSet) LoadType(vt *VersionedType) error {
-	if ts.HasTag(vt.Tag) {
-		return &TypeError{ fmt.Sprintf("Tag already exists: %d", vt.Tag) }
+// RegisterTypeWithTag registers a type under a fixed tag, so the tag
+// doesn't depend on registration order. It fails if the name or tag is
+// already bound differently by a stored or pinned type; unstored types
+// with automatic tags are moved out of the way.
+func (ts *TypeSet) RegisterTypeWithTag(name string, tag uint16) (*VersionedType, error) {
+	if tag == 0 {
+		return nil, &TypeError{ fmt.Sprintf("Invalid tag for %s: 0", name) }
+	}
+
+	var holder = ts.typeByTag(tag)
+
+	t, ok := ts.lookup(name)
+	if ok {
+		if t.Tag == tag {
+			t.Pinned = true
+			return t, nil
+		}
+		if t.Persisted || t.Pinned {
+			return nil, &TypeError{ fmt.Sprintf("Type %s already has tag %d, not %d", name, t.Tag, tag) }
+		}
+	}
+
+	if holder != nil {
+		if holder.Deleted {
+			return nil, &TypeError{ fmt.Sprintf("Tag %d belongs to deleted type %s", tag, holder.Name) }
+		}
+		if holder.Persisted || holder.Pinned {
+			return nil, &TypeError{ fmt.Sprintf("Tag %d already belongs to %s", tag, holder.Name) }
+		}
+		ts.bumpLastTag(tag)
+		ts.retag(holder)
 	}
 
-	_, ok := ts.Types[vt.Name]
+	ts.bumpLastTag(tag)
+
 	if ok {
-		return &TypeError{ fmt.Sprintf("Name already exists: %s", vt.Name) }
+		t.Tag = tag
+	} else {
+		t = &VersionedType{
+			Name: name,
+			Tag: tag,
+			Versions: make([]*Version, 0, 1),
+			Dirty: true,
+		}
+		ts.Types[name] = t
+	}
+
+	t.Pinned = true
+	return t, nil
+}
+
+// LoadType adds a stored type. If the name (or one of the stored
+// type's old names) was already registered in this process, the stored
+// tag and versions win: an automatically tagged type is moved to its
+// stored tag and its exemplars attached to the stored versions. A
+// pinned tag that disagrees with the store is an error.
+func (ts *TypeSet) LoadType(vt *VersionedType) error {
+	var existing *VersionedType
+	if !vt.Deleted {
+		existing = ts.Types[vt.Name]
+		for _, alias := range vt.Aliases {
+			if existing == nil {
+				existing = ts.Types[alias]
+			}
+		}
+	}
+
+	var holder = ts.typeByTag(vt.Tag)
+	if holder != nil && holder != existing {
+		if holder.Persisted || holder.Pinned || holder.Deleted {
+			return &TypeError{ fmt.Sprintf("Tag already exists: %d (%s, stored as %s)", vt.Tag, holder.Name, vt.Name) }
+		}
+	}
+
+	if existing != nil && existing.Tag != vt.Tag && (existing.Persisted || existing.Pinned) {
+		return &TypeError{ fmt.Sprintf("Stored tag %d for %s conflicts with registered tag %d", vt.Tag, vt.Name, existing.Tag) }
+	}
+
+	ts.bumpLastTag(vt.Tag)
+
+	if holder != nil && holder != existing {
+		ts.retag(holder)
+	}
+
+	vt.Persisted = true
+
+	if vt.Deleted {
+		ts.Tombstones[vt.Tag] = vt
+		return nil
+	}
+
+	for _, alias := range vt.Aliases {
+		ts.Aliases[alias] = vt.Name
+	}
+
+	if existing != nil {
+		if existing.Name != vt.Name {
+			delete(ts.Types, existing.Name)
+			existing.Name = vt.Name
+			ts.Types[vt.Name] = existing
+		}
+		existing.Aliases = vt.Aliases
+		return ts.mergeType(existing, vt)
 	}
 
 	ts.Types[vt.Name] = vt
+	return nil
+}
 
-	if vt.Tag > ts.LastTag {
-		ts.LastTag = vt.Tag
+// mergeType folds a stored type into one registered before the store
+// was loaded, keeping the registered object since callers hold it.
+func (ts *TypeSet) mergeType(existing *VersionedType, stored *VersionedType) error {
+	for _, sv := range stored.Versions {
+		var ev = existing.GetVersion(sv.Version)
+		if ev == nil {
+			continue
+		}
+		var diffs = DiffSpecs(sv.Spec, ev.Spec)
+		if len(diffs) > 0 {
+			return &TypeError{ fmt.Sprintf("Registered %s version %d doesn't match stored spec:\n  %s",
+					existing.Name, sv.Version, strings.Join(diffs, "\n  ")) }
+		}
+	}
+
+	var dirty = false
+	for _, ev := range existing.Versions {
+		if stored.GetVersion(ev.Version) == nil {
+			dirty = true
+		}
 	}
 
+	for _, sv := range stored.Versions {
+		if existing.GetVersion(sv.Version) == nil {
+			existing.AddVersionObj(sv)
+		}
+	}
+
+	existing.Tag = stored.Tag
+	existing.Dirty = dirty
+	existing.Persisted = true
 	return nil
 }
 
+func (ts *TypeSet) retag(vt *VersionedType) {
+	ts.LastTag++
+	vt.Tag = ts.LastTag
+}
+
+func (ts *TypeSet) bumpLastTag(tag uint16) {
+	if tag > ts.LastTag {
+		ts.LastTag = tag
+	}
+}
+
+// Type is LookupType for types known to be registered; it panics
+// otherwise.
 func (ts *TypeSet) Type(name string) *VersionedType {
+	t, err := ts.LookupType(name)
+	if err != nil {
+		panic(err.Error())
+	}
+	return t
+}
+
+func (ts *TypeSet) LookupType(name string) (*VersionedType, error) {
+	t, ok := ts.lookup(name)
+	if !ok {
+		return nil, &TypeError{ fmt.Sprintf("No such type: %s", name) }
+	}
+	return t, nil
+}
+
+// lookup finds a live type by name, falling back to aliases left by
+// RenameType.
+func (ts *TypeSet) lookup(name string) (*VersionedType, bool) {
 	t, ok := ts.Types[name]
 	if !ok {
-		panic(fmt.Sprintf("No such type: %s", name))
+		var current, aliased = ts.Aliases[name]
+		if aliased {
+			t, ok = ts.Types[current]
+		}
 	}
-	return t
+	return t, ok
 }
 
 func (ts *TypeSet) HasTag(tag uint16) bool {
+	return ts.typeByTag(tag) != nil
+}
+
+func (ts *TypeSet) typeByTag(tag uint16) *VersionedType {
 	for _, vt := range ts.Types {
 		if vt.Tag == tag {
-			return true
+			return vt
+		}
+	}
+	return ts.Tombstones[tag]
+}
+
+// RenameType renames a type, keeping its tag (and so its keys). The old
+// name stays usable as an alias until RemoveAlias is called.
+func (ts *TypeSet) RenameType(oldName string, newName string) error {
+	vt, ok := ts.Types[oldName]
+	if !ok {
+		return &TypeError{ fmt.Sprintf("No such type: %s", oldName) }
+	}
+
+	if _, exists := ts.lookup(newName); exists {
+		var current = ts.Aliases[newName]
+		if current != oldName {
+			return &TypeError{ fmt.Sprintf("Name already exists: %s", newName) }
 		}
 	}
-	return false
+
+	delete(ts.Types, oldName)
+	delete(ts.Aliases, newName)
+
+	var aliases = make([]string, 0, len(vt.Aliases) + 1)
+	for _, alias := range vt.Aliases {
+		if alias != newName {
+			aliases = append(aliases, alias)
+			ts.Aliases[alias] = newName
+		}
+	}
+	aliases = append(aliases, oldName)
+	ts.Aliases[oldName] = newName
+
+	vt.Name = newName
+	vt.Aliases = aliases
+	vt.Dirty = true
+	ts.Types[newName] = vt
+	return nil
+}
+
+// RemoveAlias ends the transition period after a rename.
+func (ts *TypeSet) RemoveAlias(alias string) error {
+	var current, ok = ts.Aliases[alias]
+	if !ok {
+		return &TypeError{ fmt.Sprintf("No such alias: %s", alias) }
+	}
+
+	var vt = ts.Types[current]
+	var aliases = make([]string, 0, len(vt.Aliases))
+	for _, a := range vt.Aliases {
+		if a != alias {
+			aliases = append(aliases, a)
+		}
+	}
+
+	delete(ts.Aliases, alias)
+	vt.Aliases = aliases
+	vt.Dirty = true
+	return nil
+}
+
+// DeleteType removes a type, leaving a tombstone so its tag is never
+// handed out again. The name itself may be registered afresh.
+func (ts *TypeSet) DeleteType(name string) error {
+	vt, ok := ts.Types[name]
+	if !ok {
+		return &TypeError{ fmt.Sprintf("No such type: %s", name) }
+	}
+
+	if name == "_type" {
+		return &TypeError{ "Can't delete _type" }
+	}
+
+	delete(ts.Types, name)
+	for _, alias := range vt.Aliases {
+		delete(ts.Aliases, alias)
+	}
+
+	vt.Aliases = nil
+	vt.Deleted = true
+	vt.Dirty = true
+	ts.Tombstones[vt.Tag] = vt
+	return nil
 }
 
 // -------------------------------
 
 func (vt *VersionedType) AddVersion(vers uint16, exemplar interface{}, upgrader UpgradeFunc) error {
+	return vt.addVersion(vers, exemplar, upgrader, true)
+}
+
+// AddVersionUnchecked is AddVersion without verifying the exemplar
+// against an already-stored spec, for deliberate compatible changes
+// (e.g. renaming a Go type) that would otherwise be rejected.
+func (vt *VersionedType) AddVersionUnchecked(vers uint16, exemplar interface{}, upgrader UpgradeFunc) error {
+	return vt.addVersion(vers, exemplar, upgrader, false)
+}
+
+func (vt *VersionedType) addVersion(vers uint16, exemplar interface{}, upgrader UpgradeFunc, check bool) error {
 	var _, v = vt.getVersion(vers)
 
 	if v != nil {
 		if v.Exemplar == nil && v.Upgrader == nil {
+			if check {
+				spec, err := MakeTypeSpecWithOptions(exemplar, vt.SpecOptions)
+				if err != nil {
+					return err
+				}
+				var diffs = DiffSpecs(v.Spec, spec)
+				if len(diffs) > 0 {
+					return &TypeError{ fmt.Sprintf("Exemplar for %s version %d doesn't match stored spec:\n  %s",
+							vt.Name, vers, strings.Join(diffs, "\n  ")) }
+				}
+				// It may name enum values the stored spec doesn't
+				if !reflect.DeepEqual(v.Spec.Structs, spec.Structs) || !reflect.DeepEqual(v.Spec.Top, spec.Top) {
+					vt.Dirty = true
+				}
+				v.Spec = spec
+			}
 			v.Exemplar = exemplar
 			v.Upgrader = upgrader
 			return nil
@@ -132,14 +419,33 @@ func (vt *VersionedType) AddVersion(vers uint16, exemplar interface{}, upgrader
 		return &TypeError{ fmt.Sprintf("Version already exists") }
 	}
 
-	var ft = MakeTypeSpec(exemplar)
+	ft, err := MakeTypeSpecWithOptions(exemplar, vt.SpecOptions)
+	if err != nil {
+		return err
+	}
 
-	vt.AddVersionObj(&Version{ vers, ft, exemplar, upgrader })
+	for _, other := range vt.Versions {
+		var conflicts = FieldNumberConflicts(other.Spec, ft)
+		if len(conflicts) > 0 {
+			return &TypeError{ fmt.Sprintf("Version %d of %s reuses field numbers of version %d:\n  %s",
+					vers, vt.Name, other.Version, strings.Join(conflicts, "\n  ")) }
+		}
+	}
+
+	vt.AddVersionObj(&Version{ Version: vers, Spec: ft, Exemplar: exemplar, Upgrader: upgrader })
 	vt.Dirty = true
 
 	return nil
 }
 
+func exemplarType(exemplar interface{}) reflect.Type {
+	var typ = reflect.TypeOf(exemplar)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
 func (vt *VersionedType) AddVersionObj(v *Version) {
 	vt.Versions = append(vt.Versions, v)
 	sort.Sort(vt)
@@ -171,30 +477,63 @@ func (vt *VersionedType) EncodeTag() []byte {
 	return buf.Bytes()
 }
 
+// DecodeKey is ParseKey for keys known to be this type's.
 func (vt *VersionedType) DecodeKey(encKey []byte) string {
 	return string(encKey[2:])
 }
 
+// ParseKey splits a key from EncodeKey into its type tag and key.
+func ParseKey(encKey []byte) (tag uint16, key string, err error) {
+	if len(encKey) < 2 {
+		return 0, "", &TypeError{ fmt.Sprintf("Encoded key too short: %d bytes", len(encKey)) }
+	}
+	return binary.BigEndian.Uint16(encKey), string(encKey[2:]), nil
+}
+
+// ParseKey checks an encoded key belongs to this type and returns its
+// key part.
+func (vt *VersionedType) ParseKey(encKey []byte) (string, error) {
+	var tag, key, err = ParseKey(encKey)
+	if err != nil {
+		return "", err
+	}
+	if tag != vt.Tag {
+		return "", &TypeError{ fmt.Sprintf("Key has tag %d, not %s's %d", tag, vt.Name, vt.Tag) }
+	}
+	return key, nil
+}
+
 func (vt *VersionedType) EncodeObj(obj interface{}) (enc []byte, err error) {
+	enc, err = vt.AppendObj(make([]byte, 0, BUFFER_SIZE), obj)
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
 
+// AppendObj appends obj's record, with its version, to dst as
+// AppendEncode does, so encoding records into a reused buffer needn't
+// allocate.
+func (vt *VersionedType) AppendObj(dst []byte, obj interface{}) ([]byte, error) {
 	if len(vt.Versions) == 0 {
-		return nil, &TypeError{ fmt.Sprintf("No versions registered for %s", vt.Name) }
+		return dst, &TypeError{ fmt.Sprintf("No versions registered for %s", vt.Name) }
 	}
 
 	var v = vt.Versions[0]
 
-	var buf = bytes.NewBuffer(make([]byte, 0, BUFFER_SIZE))
-	binary.Write(buf, binary.BigEndian, v.Version)
-
-	var writer = bufio.NewWriter(buf)
+	// Validate first so rejected objects never touch dst's spare capacity
+	var err = v.Spec.Validate(obj)
+	if err != nil {
+		return dst, err
+	}
 
-	err = SafeEncodeField(obj, v.Spec, writer)
+	var enc = binary.BigEndian.AppendUint16(dst, v.Version)
+	enc, err = AppendEncode(enc, obj, v.Spec)
 	if err != nil {
-		return nil, err
+		return dst, err
 	}
-	writer.Flush()
 
-	return buf.Bytes(), nil
+	return enc, nil
 }
 
 
@@ -204,15 +543,23 @@ func (vt *VersionedType) DecodeObj(encObj []byte, toMap bool) (obj interface{},
 		return nil, false, &TypeError{ fmt.Sprintf("No versions registered for %s", vt.Name) }
 	}
 
-	var buf = bytes.NewBuffer(encObj)
+	if len(encObj) < 2 {
+		return nil, false, &TypeError{ "Encoded object too short" }
+	}
 
-	var version uint16
-	binary.Read(buf, binary.BigEndian, &version)
+	var version = binary.BigEndian.Uint16(encObj)
 
 	var v = vt.Versions[0]
 
 	if v.Version != version {
-		return vt.upgradeObj(version, buf)
+		obj, upgraded, err = vt.upgradeObj(version, encObj[2:], toMap)
+		if err == nil && vt.ValidateOnDecode {
+			err = v.Spec.Validate(obj)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return obj, upgraded, nil
 	}
 
 	if v.Exemplar == nil {
@@ -226,8 +573,10 @@ func (vt *VersionedType) DecodeObj(encObj []byte, toMap bool) (obj interface{},
 		target = reflect.New(reflect.TypeOf(v.Exemplar)).Interface()
 	}
 
-	var reader = bufio.NewReader(buf)
-	err = SafeDecodeField(target, v.Spec, reader)
+	err = withOffset(DecodeFromBytesWithOptions(target, v.Spec, encObj[2:], vt.DecodeOptions), 2)
+	if err == nil && vt.ValidateOnDecode {
+		err = v.Spec.Validate(target)
+	}
 
 	if err != nil {
 		return nil, false, err
@@ -237,7 +586,7 @@ func (vt *VersionedType) DecodeObj(encObj []byte, toMap bool) (obj interface{},
 }
 
 
-func (vt *VersionedType) upgradeObj(version uint16, buf *bytes.Buffer) (obj interface{}, upgraded bool, err error) {
+func (vt *VersionedType) upgradeObj(version uint16, enc []byte, toMap bool) (obj interface{}, upgraded bool, err error) {
 	var vIdx, v = vt.getVersion(version)
 
 	if v == nil {
@@ -250,26 +599,33 @@ func (vt *VersionedType) upgradeObj(version uint16, buf *bytes.Buffer) (obj inte
 		obj = make(map[string]interface{})
 	}
 
-	var reader = bufio.NewReader(buf)
-	err = SafeDecodeField(obj, v.Spec, reader)
+	err = DecodeFromBytesWithOptions(obj, v.Spec, enc, vt.DecodeOptions)
 
 	if err != nil {
-		return nil, false, &TypeError{ fmt.Sprintf("Error decoding initial version %d: %v", 
-				v.Version, err) }
+		return nil, false, withOffset(err, 2)
 	}
 
 	for vIdx > 0 {
+		var prev = vt.Versions[vIdx]
 		vIdx--
 		var next = vt.Versions[vIdx]
 		if next.Upgrader == nil {
-			return nil, false, &TypeError{ fmt.Sprintf("No upgrader for %d -> %d (object version %d)", v.Version, next.Version, version) }
+			return nil, false, &TypeError{ fmt.Sprintf("No upgrader for %d -> %d (object version %d)", prev.Version, next.Version, version) }
 		}
 
-		fmt.Printf("Upgrading %d -> %d\n", next.Version-1, next.Version)
 		obj, err = next.Upgrader(obj)
-		
 		if err != nil {
-			return nil, false, &TypeError{ fmt.Sprintf("Upgrader error: %v", err) }
+			return nil, false, &UpgradeError{ prev.Version, next.Version, err }
+		}
+
+		// Map upgraders' output takes the version's own type, unless
+		// a map was asked for
+		if m, ok := obj.(map[string]interface{}); ok && next.Exemplar != nil && !(toMap && vIdx == 0) {
+			var typed = reflect.New(exemplarType(next.Exemplar))
+			if err = assignValue(typed.Elem(), m); err != nil {
+				return nil, false, &UpgradeError{ prev.Version, next.Version, err }
+			}
+			obj = typed.Interface()
 		}
 	}
 
@@ -282,10 +638,11 @@ func (vt *VersionedType) DecodeInto(encObj []byte, obj map[string]interface{}) e
 		return &TypeError{ fmt.Sprintf("No versions registered for %s", vt.Name) }
 	}
 
-	var buf = bytes.NewBuffer(encObj)
+	if len(encObj) < 2 {
+		return &TypeError{ "Encoded object too short" }
+	}
 
-	var version uint16
-	binary.Read(buf, binary.BigEndian, &version)
+	var version = binary.BigEndian.Uint16(encObj)
 
 	var _, v = vt.getVersion(version)
 
@@ -293,11 +650,10 @@ func (vt *VersionedType) DecodeInto(encObj []byte, obj map[string]interface{}) e
 		return &TypeError{ fmt.Sprintf("Version not registered: %d", version) }
 	}
 
-	var reader = bufio.NewReader(buf)
-	var err = SafeDecodeField(obj, v.Spec, reader)
+	var err = DecodeFromBytesWithOptions(obj, v.Spec, encObj[2:], vt.DecodeOptions)
 
 	if err != nil {
-		return err
+		return withOffset(err, 2)
 	}
 
 	obj["_version"] = v.Version
@@ -1,6 +1,7 @@
 package spack
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -224,3 +225,198 @@ func TestUpgrade (test *testing.T) {
 
 }
 
+
+func TestExemplarVerification(test *testing.T) {
+	type st0 struct {
+		Name string
+		Age uint16
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("test")
+	vt.AddVersion(0, st0{}, nil)
+
+	// As if loaded from a stored _type record
+	vt.GetVersion(0).Exemplar = nil
+
+	{
+		type st0 struct {
+			Name string
+			Age uint32
+			Extra bool
+		}
+
+		var err = vt.AddVersion(0, st0{}, nil)
+		if err == nil {
+			test.Fatalf("Mismatched exemplar accepted")
+		}
+
+		var msg = err.Error()
+		if !strings.Contains(msg, "st0.Age: kind uint16 != uint32") ||
+			!strings.Contains(msg, "st0.Extra: field added") {
+			test.Errorf("Wrong mismatch error: %s", msg)
+		}
+
+		if vt.GetVersion(0).Exemplar != nil {
+			test.Errorf("Mismatched exemplar attached")
+		}
+	}
+
+	var err = vt.AddVersion(0, st0{}, nil)
+	if err != nil {
+		test.Errorf("Matching exemplar rejected: %v", err)
+	}
+
+	vt.GetVersion(0).Exemplar = nil
+
+	type other struct {
+		Name string
+	}
+
+	err = vt.AddVersionUnchecked(0, other{}, nil)
+	if err != nil || vt.GetVersion(0).Exemplar == nil {
+		test.Errorf("Unchecked registration failed: %v", err)
+	}
+}
+
+func TestRenameType(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+	var tag = vt.Tag
+	var key = vt.EncodeKey("brend")
+
+	var err = ts.RenameType("user", "account")
+	if err != nil {
+		test.Fatalf("Rename failed: %v", err)
+	}
+
+	if vt.Name != "account" || vt.Tag != tag || ts.Type("account") != vt {
+		test.Errorf("Wrong renamed type: %#v", vt)
+	}
+
+	if string(vt.EncodeKey("brend")) != string(key) {
+		test.Errorf("Rename changed keys")
+	}
+
+	// Old name still resolves during the transition
+	if ts.Type("user") != vt || ts.RegisterType("user") != vt {
+		test.Errorf("Alias doesn't resolve")
+	}
+
+	if ts.RenameType("account", "_type") == nil {
+		test.Errorf("Renamed onto an existing type")
+	}
+
+	err = ts.RemoveAlias("user")
+	if err != nil || len(vt.Aliases) != 0 {
+		test.Errorf("Couldn't remove alias: %v", err)
+	}
+
+	if ts.RegisterType("user") == vt {
+		test.Errorf("Removed alias still resolves")
+	}
+}
+
+func TestDeleteType(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("user")
+	var tag = vt.Tag
+
+	var err = ts.DeleteType("user")
+	if err != nil {
+		test.Fatalf("Delete failed: %v", err)
+	}
+
+	if !vt.Deleted || ts.Tombstones[tag] != vt || !ts.HasTag(tag) {
+		test.Errorf("No tombstone for deleted type")
+	}
+
+	var again = ts.RegisterType("user")
+	if again == vt || again.Tag == tag {
+		test.Errorf("Deleted tag reused: %d", again.Tag)
+	}
+
+	_, err = ts.RegisterTypeWithTag("other", tag)
+	if err == nil {
+		test.Errorf("Pinned a deleted tag")
+	}
+
+	if ts.DeleteType("_type") == nil {
+		test.Errorf("Deleted _type")
+	}
+}
+
+func TestFieldNumberStability(test *testing.T) {
+	type v0 struct {
+		_ struct{} `spack:"name=stable"`
+		ID uint32 `spack:"n=1"`
+		Name string `spack:"n=2"`
+	}
+
+	type renamed struct {
+		_ struct{} `spack:"name=stable"`
+		Ident uint32 `spack:"n=1"`
+		Name string `spack:"n=2"`
+		Email string `spack:"n=3"`
+	}
+
+	type retyped struct {
+		_ struct{} `spack:"name=stable"`
+		ID uint64 `spack:"n=1"`
+	}
+
+	type renumbered struct {
+		_ struct{} `spack:"name=stable"`
+		ID uint32 `spack:"n=1"`
+		Name string `spack:"n=4"`
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("stable")
+	vt.AddVersion(0, v0{}, nil)
+
+	err := vt.AddVersion(1, renamed{}, nil)
+	if err != nil {
+		test.Errorf("Renaming numbered field refused: %v", err)
+	}
+
+	err = vt.AddVersion(2, retyped{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "field number 1 was Ident uint32") {
+		test.Errorf("Retyped field number allowed: %v", err)
+	}
+
+	err = vt.AddVersion(3, renumbered{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "renumbered from 2 to 4") {
+		test.Errorf("Renumbered field allowed: %v", err)
+	}
+}
+
+func TestAppendObj(test *testing.T) {
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("record")
+	vt.AddVersion(0, appendRecord{}, nil)
+	vt.AddVersion(1, appendRecord{}, func(obj interface{}) (interface{}, error) {
+		return obj, nil
+	})
+
+	var rec = appendRecord{ Name: "ann", Tags: map[string]int32{ "a": 1 }, Addresses: []errAddress{ { "a", "1" } } }
+
+	var buf, err = vt.AppendObj(nil, &rec)
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+	obj, _, err := vt.DecodeObj(buf, false)
+	if err != nil || obj.(*appendRecord).Name != "ann" {
+		test.Errorf("Wrong round trip: %v %v", err, obj)
+	}
+	if enc, _ := vt.EncodeObj(&rec); string(enc) != string(buf) {
+		test.Errorf("AppendObj differs from EncodeObj: %x %x", buf, enc)
+	}
+
+	var allocs = testing.AllocsPerRun(100, func() {
+		buf, err = vt.AppendObj(buf[:0], &rec)
+	})
+	if err != nil || (allocs != 0 && !raceEnabled) {
+		test.Errorf("AppendObj allocates: %v %v", allocs, err)
+	}
+}
@@ -0,0 +1,507 @@
+package spack
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Upgrade adds version vers of vt with To as its exemplar, upgraded
+// from the version before it by fn. It fails if that version's
+// exemplar isn't a From. The incoming object may be a *From, a From, or
+// the map-mode form produced when the older version has no exemplar;
+// maps are converted to a *From by field name.
+func Upgrade[From, To any](vt *VersionedType, vers uint16, fn func(*From) (*To, error)) error {
+	var from = reflect.TypeOf((*From)(nil)).Elem()
+
+	var prev *Version
+	for _, v := range vt.Versions {
+		if v.Version < vers {
+			prev = v
+			break
+		}
+	}
+	if prev == nil {
+		return &TypeError{ fmt.Sprintf("No version of %s before %d to upgrade from", vt.Name, vers) }
+	}
+	if typ := exemplarType(prev.Exemplar); typ != nil && typ != from {
+		return &TypeError{ fmt.Sprintf("Upgrader from %s version %d takes %v, but its exemplar is %v",
+				vt.Name, prev.Version, from, typ) }
+	}
+
+	return vt.AddVersion(vers, *new(To), typedUpgrader(fn))
+}
+
+func typedUpgrader[From, To any](fn func(*From) (*To, error)) UpgradeFunc {
+	return func(obj interface{}) (interface{}, error) {
+		var from *From
+
+		switch o := obj.(type) {
+		case *From:
+			from = o
+		case From:
+			from = &o
+		default:
+			from = new(From)
+			var err = assignValue(reflect.ValueOf(from).Elem(), obj)
+			if err != nil {
+				return nil, &TypeError{ fmt.Sprintf("Can't convert %T to %T: %v", obj, from, err) }
+			}
+		}
+
+		to, err := fn(from)
+		if err != nil {
+			return nil, err
+		}
+		if to == nil {
+			return nil, &TypeError{ fmt.Sprintf("Upgrader returned nil %T", to) }
+		}
+		return to, nil
+	}
+}
+
+// MapStep is one declarative change to a map-mode object.
+type MapStep func(obj map[string]interface{}) error
+
+// MapUpgrade composes steps into an UpgradeFunc. Struct inputs are
+// converted to map-mode first, so the steps always see a map. The
+// result is converted to the new version's exemplar type, if it has
+// one, when the upgrade runs.
+func MapUpgrade(steps ...MapStep) UpgradeFunc {
+	return func(obj interface{}) (interface{}, error) {
+		var m, err = toMap(obj)
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range steps {
+			err = step(m)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+}
+
+// Field names in steps may be dotted paths into nested structs,
+// e.g. "Address.Zip".
+
+func RenameField(from string, to string) MapStep {
+	return func(obj map[string]interface{}) error {
+		var src, srcKey, err = fieldParent(obj, from)
+		if err != nil || src == nil {
+			return err
+		}
+		val, ok := src[srcKey]
+		if !ok {
+			return nil
+		}
+		dst, dstKey, err := fieldParent(obj, to)
+		if err != nil {
+			return err
+		}
+		if dst == nil {
+			return &TypeError{ fmt.Sprintf("RenameField: no parent for %s", to) }
+		}
+		delete(src, srcKey)
+		dst[dstKey] = val
+		return nil
+	}
+}
+
+func AddField(name string, def interface{}) MapStep {
+	return func(obj map[string]interface{}) error {
+		var parent, key, err = fieldParent(obj, name)
+		if err != nil || parent == nil {
+			return err
+		}
+		if _, ok := parent[key]; !ok {
+			parent[key] = def
+		}
+		return nil
+	}
+}
+
+func DropField(name string) MapStep {
+	return func(obj map[string]interface{}) error {
+		var parent, key, err = fieldParent(obj, name)
+		if err != nil || parent == nil {
+			return err
+		}
+		delete(parent, key)
+		return nil
+	}
+}
+
+// WidenInt converts an integer field to the given (wider) integer kind,
+// failing if the stored value doesn't fit.
+func WidenInt(name string, kind reflect.Kind) MapStep {
+	return MapValues(name, func(val interface{}) (interface{}, error) {
+		if val == nil {
+			return nil, nil
+		}
+		var target = kindTypes[kind]
+		if target == nil || !isIntKind(kind) {
+			return nil, &TypeError{ fmt.Sprintf("WidenInt: %v is not an integer kind", kind) }
+		}
+		var out = reflect.New(target).Elem()
+		var err = assignValue(out, val)
+		if err != nil {
+			return nil, &TypeError{ fmt.Sprintf("WidenInt %s: %v", name, err) }
+		}
+		return out.Interface(), nil
+	})
+}
+
+// MapValues replaces a field's value with fn(value). Absent fields are
+// left alone.
+func MapValues(name string, fn func(interface{}) (interface{}, error)) MapStep {
+	return func(obj map[string]interface{}) error {
+		var parent, key, err = fieldParent(obj, name)
+		if err != nil || parent == nil {
+			return err
+		}
+		val, ok := parent[key]
+		if !ok {
+			return nil
+		}
+		val, err = fn(val)
+		if err != nil {
+			return err
+		}
+		parent[key] = val
+		return nil
+	}
+}
+
+// fieldParent resolves a dotted path to the map holding its last
+// component. A nil map means an intermediate struct was absent.
+func fieldParent(obj map[string]interface{}, path string) (map[string]interface{}, string, error) {
+	var bits = strings.Split(path, ".")
+	var cur = obj
+	for _, bit := range bits[:len(bits)-1] {
+		var next, ok = cur[bit]
+		if !ok || next == nil {
+			return nil, "", nil
+		}
+		switch n := next.(type) {
+		case map[string]interface{}:
+			cur = n
+		case *map[string]interface{}:
+			cur = *n
+		default:
+			return nil, "", &TypeError{ fmt.Sprintf("Field %s in %s is not a struct", bit, path) }
+		}
+	}
+	return cur, bits[len(bits)-1], nil
+}
+
+// -------------------------------
+
+var kindTypes = map[reflect.Kind]reflect.Type{
+	reflect.Int8: reflect.TypeOf(int8(0)),
+	reflect.Int16: reflect.TypeOf(int16(0)),
+	reflect.Int32: reflect.TypeOf(int32(0)),
+	reflect.Int64: reflect.TypeOf(int64(0)),
+	reflect.Uint8: reflect.TypeOf(uint8(0)),
+	reflect.Uint16: reflect.TypeOf(uint16(0)),
+	reflect.Uint32: reflect.TypeOf(uint32(0)),
+	reflect.Uint64: reflect.TypeOf(uint64(0)),
+	reflect.Float32: reflect.TypeOf(float32(0)),
+	reflect.Float64: reflect.TypeOf(float64(0)),
+	reflect.Complex64: reflect.TypeOf(complex64(0)),
+	reflect.Complex128: reflect.TypeOf(complex128(0)),
+	reflect.Bool: reflect.TypeOf(false),
+	reflect.String: reflect.TypeOf(""),
+}
+
+func isIntKind(kind reflect.Kind) bool {
+	return (kind >= reflect.Int && kind <= reflect.Int64) ||
+		(kind >= reflect.Uint && kind <= reflect.Uintptr)
+}
+
+func isFloatKind(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// toMap returns the map-mode form of a struct, or the map itself.
+func toMap(obj interface{}) (map[string]interface{}, error) {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		return o, nil
+	case *map[string]interface{}:
+		return *o, nil
+	}
+
+	var m, ok = toMapValue(reflect.ValueOf(obj)).(map[string]interface{})
+	if !ok {
+		return nil, &TypeError{ fmt.Sprintf("Can't convert %T to a map", obj) }
+	}
+	return m, nil
+}
+
+// toMapValue converts val to the loose form map upgraders work on:
+// structs become maps keyed by field label, big numbers strings, and
+// slices and maps their interface{} equivalents. Unlike map-mode
+// decoding it has no spec, so enums stay numbers and embedded structs
+// stay nested under their field names.
+func toMapValue(val reflect.Value) interface{} {
+	if !val.IsValid() {
+		return nil
+	}
+
+	if kind, ok := bigKindOf(val.Type()); ok {
+		var ptr, _ = bigValue(val.Interface(), kind)
+		if ptr == nil {
+			return nil
+		}
+		return bigText(ptr)
+	}
+
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return nil
+		}
+		return toMapValue(val.Elem())
+
+	case reflect.Struct:
+		var out = make(map[string]interface{})
+		var typ = val.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			var field = typ.Field(i)
+			if field.PkgPath != "" || parseTag(field.Tag).has("ignore") {
+				continue
+			}
+			out[fieldLabel(field)] = toMapValue(val.Field(i))
+		}
+		return out
+
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.Type().Elem() == byteType {
+			return append([]byte{}, val.Bytes()...)
+		}
+		var out = make([]interface{}, val.Len())
+		for i := range out {
+			out[i] = toMapValue(val.Index(i))
+		}
+		return out
+
+	case reflect.Map:
+		var out = make(map[interface{}]interface{})
+		for _, key := range val.MapKeys() {
+			out[toMapValue(key)] = toMapValue(val.MapIndex(key))
+		}
+		return out
+	}
+
+	return val.Interface()
+}
+
+// assignValue stores a loosely typed (map-mode or JSON-ish) value into
+// dst, converting numbers, maps and slices as needed.
+func assignValue(dst reflect.Value, src interface{}) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	var sv = reflect.ValueOf(src)
+	if sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return nil
+	}
+
+	// Big numbers come from map mode as strings
+	if kind, ok := bigKindOf(dst.Type()); ok {
+		var ptr, err = bigValue(src, kind)
+		switch {
+		case err != nil:
+			return err
+		case ptr == nil:
+			dst.Set(reflect.Zero(dst.Type()))
+		case dst.Kind() == reflect.Ptr:
+			dst.Set(reflect.ValueOf(ptr))
+		default:
+			dst.Set(reflect.ValueOf(ptr).Elem())
+		}
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Interface:
+		if !sv.Type().Implements(dst.Type()) {
+			return fmt.Errorf("%T does not implement %v", src, dst.Type())
+		}
+		dst.Set(sv)
+		return nil
+
+	case reflect.Ptr:
+		if sv.Kind() == reflect.Ptr {
+			if sv.IsNil() {
+				dst.Set(reflect.Zero(dst.Type()))
+				return nil
+			}
+			src = sv.Elem().Interface()
+		}
+		var target = reflect.New(dst.Type().Elem())
+		var err = assignValue(target.Elem(), src)
+		if err != nil {
+			return err
+		}
+		dst.Set(target)
+		return nil
+	}
+
+	if sv.Kind() == reflect.Ptr {
+		if sv.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		return assignValue(dst, sv.Elem().Interface())
+	}
+
+	switch dst.Kind() {
+	case reflect.Struct:
+		var m, err = toMap(src)
+		if err != nil {
+			return err
+		}
+		var typ = dst.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			var field = typ.Field(i)
+			if field.PkgPath != "" || parseTag(field.Tag).has("ignore") {
+				continue
+			}
+			val, ok := m[fieldLabel(field)]
+			if !ok {
+				// Flattened embedded structs keep their fields in the parent
+				if field.Anonymous {
+					err = assignValue(dst.Field(i), m)
+					if err != nil {
+						return fmt.Errorf("%s: %v", field.Name, err)
+					}
+				}
+				continue
+			}
+			err = assignValue(dst.Field(i), val)
+			if err != nil {
+				return fmt.Errorf("%s: %v", field.Name, err)
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		if sv.Kind() != reflect.Slice && sv.Kind() != reflect.Array {
+			break
+		}
+		var out = reflect.MakeSlice(dst.Type(), sv.Len(), sv.Len())
+		for i := 0; i < sv.Len(); i++ {
+			var err = assignValue(out.Index(i), sv.Index(i).Interface())
+			if err != nil {
+				return fmt.Errorf("[%d]: %v", i, err)
+			}
+		}
+		dst.Set(out)
+		return nil
+
+	case reflect.Map:
+		if sv.Kind() != reflect.Map {
+			break
+		}
+		var out = reflect.MakeMapWithSize(dst.Type(), sv.Len())
+		var keyt = dst.Type().Key()
+		var valt = dst.Type().Elem()
+		for _, key := range sv.MapKeys() {
+			var k = reflect.New(keyt).Elem()
+			var err = assignValue(k, key.Interface())
+			if err != nil {
+				return fmt.Errorf("key %v: %v", key, err)
+			}
+			var v = reflect.New(valt).Elem()
+			err = assignValue(v, sv.MapIndex(key).Interface())
+			if err != nil {
+				return fmt.Errorf("[%v]: %v", key, err)
+			}
+			out.SetMapIndex(k, v)
+		}
+		dst.Set(out)
+		return nil
+
+	case reflect.Bool, reflect.String:
+		if sv.Kind() == dst.Kind() {
+			dst.Set(sv.Convert(dst.Type()))
+			return nil
+		}
+
+	default:
+		return assignNumber(dst, sv)
+	}
+
+	return fmt.Errorf("can't assign %T to %v", src, dst.Type())
+}
+
+func assignNumber(dst reflect.Value, sv reflect.Value) error {
+	var dk = dst.Kind()
+	var sk = sv.Kind()
+
+	switch {
+	case isIntKind(dk) && isIntKind(sk):
+		if sk >= reflect.Uint {
+			var u = sv.Uint()
+			if dk >= reflect.Uint {
+				if dst.OverflowUint(u) {
+					return fmt.Errorf("%d overflows %v", u, dst.Type())
+				}
+				dst.SetUint(u)
+				return nil
+			}
+			if u > 1<<63-1 || dst.OverflowInt(int64(u)) {
+				return fmt.Errorf("%d overflows %v", u, dst.Type())
+			}
+			dst.SetInt(int64(u))
+			return nil
+		}
+
+		var i = sv.Int()
+		if dk >= reflect.Uint {
+			if i < 0 || dst.OverflowUint(uint64(i)) {
+				return fmt.Errorf("%d overflows %v", i, dst.Type())
+			}
+			dst.SetUint(uint64(i))
+			return nil
+		}
+		if dst.OverflowInt(i) {
+			return fmt.Errorf("%d overflows %v", i, dst.Type())
+		}
+		dst.SetInt(i)
+		return nil
+
+	case isIntKind(dk) && sk == reflect.String:
+		// Map-mode enums are by name
+		var n, ok = enumNumber(enumValues(dst.Type()), sv.String())
+		if !ok {
+			return fmt.Errorf("%q is not a %v", sv.String(), dst.Type())
+		}
+		return assignNumber(dst, reflect.ValueOf(n))
+
+	case isIntKind(dk) && isFloatKind(sk):
+		// JSON numbers arrive as float64
+		var f = sv.Float()
+		if f != float64(int64(f)) {
+			return fmt.Errorf("%v is not an integer", f)
+		}
+		return assignNumber(dst, reflect.ValueOf(int64(f)))
+
+	case isFloatKind(dk) && (isIntKind(sk) || isFloatKind(sk)):
+		dst.Set(sv.Convert(dst.Type()))
+		return nil
+
+	case (dk == reflect.Complex64 || dk == reflect.Complex128) &&
+		(sk == reflect.Complex64 || sk == reflect.Complex128):
+		dst.Set(sv.Convert(dst.Type()))
+		return nil
+	}
+
+	return fmt.Errorf("can't assign %v to %v", sv.Type(), dst.Type())
+}
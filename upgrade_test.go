@@ -0,0 +1,220 @@
+package spack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTypedUpgrade(test *testing.T) {
+	type st0 struct {
+		Name string
+		Tags []string
+	}
+
+	type st1 struct {
+		Name string
+		Tags []string
+		Age uint16
+	}
+
+	type st2 struct {
+		Moniker string
+		Age uint32
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("test")
+	vt.AddVersion(0, st0{}, nil)
+
+	enc, err := vt.EncodeObj(&st0{ "Brend", []string{ "a", "b" } })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	// From must be the previous version's exemplar
+	err = Upgrade(vt, 1, func(obj *st1) (*st1, error) {
+		return obj, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "version 0 takes") || vt.GetVersion(1) != nil {
+		test.Errorf("Wrong From type accepted: %v", err)
+	}
+	if err = Upgrade(vt, 0, func(obj *st0) (*st0, error) { return obj, nil }); err == nil {
+		test.Errorf("Upgrade with no earlier version accepted")
+	}
+
+	err = Upgrade(vt, 1, func(obj *st0) (*st1, error) {
+		if len(obj.Tags) != 2 || obj.Tags[1] != "b" {
+			test.Errorf("Wrong tags in upgrader: %v", obj.Tags)
+		}
+		return &st1{ obj.Name, obj.Tags, 32 }, nil
+	})
+	if err != nil {
+		test.Fatalf("Registration error: %v", err)
+	}
+
+	err = Upgrade(vt, 2, func(obj *st1) (*st2, error) {
+		return &st2{ obj.Name, uint32(obj.Age) }, nil
+	})
+	if err != nil {
+		test.Fatalf("Registration error: %v", err)
+	}
+	if _, ok := vt.GetVersion(2).Exemplar.(st2); !ok {
+		test.Errorf("Wrong exemplar: %#v", vt.GetVersion(2).Exemplar)
+	}
+
+	// Old versions without exemplars arrive as maps
+	vt.GetVersion(0).Exemplar = nil
+
+	out, upgraded, err := vt.DecodeObj(enc, false)
+	if err != nil {
+		test.Fatalf("Error decoding: %v", err)
+	}
+
+	var final, ok = out.(*st2)
+	if !upgraded || !ok || final.Moniker != "Brend" || final.Age != 32 {
+		test.Errorf("Wrong upgrade result: %#v", out)
+	}
+}
+
+func TestMapUpgrade(test *testing.T) {
+	type st0 struct {
+		Name string
+		Count int16
+	}
+
+	type st1 struct {
+		Moniker string
+		Count int64
+		Age uint16
+		Status string
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("test")
+	vt.AddVersion(0, st0{}, nil)
+
+	enc, err := vt.EncodeObj(&st0{ "Brend", -3 })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	vt.AddVersion(1, st1{}, MapUpgrade(
+		RenameField("Name", "Moniker"),
+		WidenInt("Count", reflect.Int64),
+		AddField("Age", 32),
+		AddField("Status", "new"),
+		MapValues("Status", func(val interface{}) (interface{}, error) {
+			return val.(string) + "!", nil
+		}),
+		DropField("Missing"),
+	))
+
+	out, _, err := vt.DecodeObj(enc, true)
+	if err != nil {
+		test.Fatalf("Error decoding: %v", err)
+	}
+
+	var obj = out.(map[string]interface{})
+	if obj["Moniker"] != "Brend" || obj["Count"] != int64(-3) ||
+		obj["Age"] != 32 || obj["Status"] != "new!" {
+		test.Errorf("Wrong upgrade result: %#v", obj)
+	}
+
+	if _, ok := obj["Name"]; ok {
+		test.Errorf("Renamed field still present: %#v", obj)
+	}
+
+	// Without toMap the result takes the exemplar's type
+	out, _, err = vt.DecodeObj(enc, false)
+	if err != nil {
+		test.Fatalf("Error decoding: %v", err)
+	}
+
+	var typed, ok = out.(*st1)
+	if !ok || typed.Moniker != "Brend" || typed.Count != -3 || typed.Age != 32 || typed.Status != "new!" {
+		test.Errorf("Wrong typed upgrade result: %#v", out)
+	}
+
+	enc, err = vt.EncodeObj(obj)
+	if err != nil {
+		test.Fatalf("Error re-encoding: %v", err)
+	}
+
+	final, _, err := vt.DecodeObj(enc, false)
+	if err != nil {
+		test.Fatalf("Error decoding upgraded: %v", err)
+	}
+
+	var finalObj = final.(*st1)
+	if finalObj.Moniker != "Brend" || finalObj.Count != -3 || finalObj.Age != 32 {
+		test.Error(finalObj)
+	}
+}
+
+func TestMapUpgradeLabels(test *testing.T) {
+	type st0 struct {
+		Name string `spack:"label=name"`
+	}
+
+	type st1 struct {
+		Moniker string `spack:"label=moniker"`
+	}
+
+	var ts = NewTypeSet()
+	var vt = ts.RegisterType("test")
+	vt.AddVersion(0, st0{}, nil)
+
+	enc, err := vt.EncodeObj(&st0{ "Brend" })
+	if err != nil {
+		test.Fatalf("Encoding error: %v", err)
+	}
+
+	// Typed values reach map steps keyed by label, as map mode has them
+	vt.AddVersion(1, st1{}, MapUpgrade(RenameField("name", "moniker")))
+
+	out, _, err := vt.DecodeObj(enc, false)
+	if err != nil {
+		test.Fatalf("Error decoding: %v", err)
+	}
+
+	var typed, ok = out.(*st1)
+	if !ok || typed.Moniker != "Brend" {
+		test.Errorf("Wrong typed upgrade result: %#v", out)
+	}
+}
+
+func TestWidenIntOverflow(test *testing.T) {
+	var step = WidenInt("Count", reflect.Uint8)
+
+	var obj = map[string]interface{}{ "Count": int32(300) }
+	if step(obj) == nil {
+		test.Errorf("Expected overflow error: %v", obj)
+	}
+
+	obj = map[string]interface{}{ "Count": int32(-1) }
+	if step(obj) == nil {
+		test.Errorf("Expected sign error: %v", obj)
+	}
+}
+
+func TestNestedMapSteps(test *testing.T) {
+	var obj = map[string]interface{}{
+		"Address": map[string]interface{}{ "Zip": "1234" },
+	}
+
+	var upgrade = MapUpgrade(
+		RenameField("Address.Zip", "Address.Postcode"),
+		AddField("Address.Country", "NZ"),
+	)
+
+	out, err := upgrade(obj)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	var addr = out.(map[string]interface{})["Address"].(map[string]interface{})
+	if addr["Postcode"] != "1234" || addr["Country"] != "NZ" || addr["Zip"] != nil {
+		test.Errorf("Wrong nested result: %#v", addr)
+	}
+}